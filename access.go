@@ -0,0 +1,198 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// how often access file is checked for changes
+	accessCheckInterval = 10 * time.Second
+
+	// denied clients are logged once per interval with the number of skipped ones
+	accessLogInterval = 10 * time.Second
+)
+
+// readAccessFile reads lines "allow <cidr>" and "deny <cidr>", empty lines and lines starting with # are skipped
+func readAccessFile(path string) ([]string, []string, error) {
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, errors.Errorf("fail to read access file '%s', %v", path, err)
+	}
+
+	var allow, deny []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, nil, errors.Errorf("access file '%s' line %d, expected allow or deny with cidr", path, n)
+		}
+		switch fields[0] {
+		case "allow":
+			allow = append(allow, fields[1])
+		case "deny":
+			deny = append(deny, fields[1])
+		default:
+			return nil, nil, errors.Errorf("access file '%s' line %d, unknown action '%s'", path, n, fields[0])
+		}
+	}
+
+	if _, err := parseCIDRs(allow); err != nil {
+		return nil, nil, errors.Errorf("access file '%s', %v", path, err)
+	}
+	if _, err := parseCIDRs(deny); err != nil {
+		return nil, nil, errors.Errorf("access file '%s', %v", path, err)
+	}
+	return allow, deny, nil
+}
+
+// accessList allows and denies clients by networks of the route and of the access file,
+// deny wins, all clients not denied are allowed if allow lists are empty
+type accessList struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+
+	file string
+	log  *log.Logger
+	name string
+
+	mu        sync.Mutex
+	fileAllow []*net.IPNet
+	fileDeny  []*net.IPNet
+	fileMod   time.Time
+	lastCheck time.Time
+
+	allowed atomic.Int64
+	denied  atomic.Int64
+
+	sparse sparseLog
+}
+
+func newAccessList(route Route, log *log.Logger) (*accessList, error) {
+
+	t := &accessList{file: route.AccessFile, log: log, name: route.ListenAddr, sparse: sparseLog{interval: accessLogInterval}}
+
+	var err error
+	if t.allow, err = parseCIDRs(route.Allow); err != nil {
+		return nil, errors.Errorf("invalid allow list, %v", err)
+	}
+	if t.deny, err = parseCIDRs(route.Deny); err != nil {
+		return nil, errors.Errorf("invalid deny list, %v", err)
+	}
+
+	if t.file != "" {
+		if err := t.load(); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *accessList) String() string {
+	return fmt.Sprintf("AccessList {allowed=%d denied=%d}", t.allowed.Load(), t.denied.Load())
+}
+
+func (t *accessList) load() error {
+
+	info, err := os.Stat(t.file)
+	if err != nil {
+		return errors.Errorf("fail to read access file, %v", err)
+	}
+
+	allow, deny, err := readAccessFile(t.file)
+	if err != nil {
+		return err
+	}
+
+	t.fileAllow, _ = parseCIDRs(allow)
+	t.fileDeny, _ = parseCIDRs(deny)
+	t.fileMod, t.lastCheck = info.ModTime(), time.Now()
+	return nil
+}
+
+// reload reads access file again when its modification time changes, failed file keeps previous lists
+func (t *accessList) reload() {
+
+	if t.file == "" || time.Since(t.lastCheck) < accessCheckInterval {
+		return
+	}
+	t.lastCheck = time.Now()
+
+	info, err := os.Stat(t.file)
+	if err != nil {
+		t.log.Printf("ProxyServe '%s' access file error, keep previous lists, %v\n", t.name, err)
+		return
+	}
+	if info.ModTime().Equal(t.fileMod) {
+		return
+	}
+	// file of failed reload is not loaded again until it changes
+	t.fileMod = info.ModTime()
+
+	allow, deny, err := readAccessFile(t.file)
+	if err != nil {
+		t.log.Printf("ProxyServe '%s' reload access file error, keep previous lists, %v\n", t.name, err)
+		return
+	}
+
+	t.fileAllow, _ = parseCIDRs(allow)
+	t.fileDeny, _ = parseCIDRs(deny)
+	t.log.Printf("ProxyServe '%s' reloaded access file '%s'\n", t.name, t.file)
+}
+
+// permit checks client address, clients without ip address like unix socket peers are allowed
+func (t *accessList) permit(addr net.Addr) bool {
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	ip := tcpAddr.IP
+
+	t.mu.Lock()
+	t.reload()
+	permitted := !containsIP(t.deny, ip) && !containsIP(t.fileDeny, ip) &&
+		((len(t.allow) == 0 && len(t.fileAllow) == 0) || containsIP(t.allow, ip) || containsIP(t.fileAllow, ip))
+	t.mu.Unlock()
+
+	if permitted {
+		t.allowed.Inc()
+	} else {
+		t.denied.Inc()
+	}
+	return permitted
+}
+
+// denied checks client of accepted connection, denied client is logged and its connection closed
+func (t *proxyServer) denied(conn net.Conn) bool {
+
+	if t.access.permit(conn.RemoteAddr()) {
+		return false
+	}
+
+	if skipped, ok := t.access.sparse.allow(); ok {
+		t.log.Printf("ProxyServe '%s' denied client '%s', skipped %d messages %v\n", t.listenAddr, addrString(conn.RemoteAddr()), skipped, t.access)
+	}
+
+	conn.Close()
+	return true
+}
@@ -0,0 +1,145 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAccessList(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "access.txt")
+	require.NoError(t, ioutil.WriteFile(path, []byte("# office\nallow 192.0.2.0/24\n\ndeny 192.0.2.66\n"), 0600))
+
+	access, err := newAccessList(Route{Allow: []string{"2001:db8::/32"}, AccessFile: path}, log.Default())
+	require.NoError(t, err)
+
+	addr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 50000}
+	}
+
+	require.True(t, access.permit(addr("192.0.2.10")))
+	require.True(t, access.permit(addr("2001:db8::10")))
+	require.False(t, access.permit(addr("192.0.2.66")))
+	require.False(t, access.permit(addr("198.51.100.1")))
+	require.True(t, access.permit(&net.UnixAddr{Name: "@", Net: "unix"}))
+
+	// changed file is reloaded, invalid one keeps previous lists
+	defer func(interval time.Duration) { accessCheckInterval = interval }(accessCheckInterval)
+	accessCheckInterval = 0
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("allow 198.51.100.0/24\n"), 0600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	require.True(t, access.permit(addr("198.51.100.1")))
+	require.False(t, access.permit(addr("192.0.2.10")))
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("allow everyone\n"), 0600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute)))
+	require.True(t, access.permit(addr("198.51.100.1")))
+
+	require.Equal(t, int64(3), access.denied.Load())
+
+	for _, content := range []string{"allow\n", "permit 10.0.0.0/8\n", "deny 10.0.0.0/33\n"} {
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+		_, _, err := readAccessFile(path)
+		require.Error(t, err, content)
+	}
+}
+
+func TestAccessDenied(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// backend answers once and closes
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.CopyN(conn, conn, 4)
+			}()
+		}
+	}()
+
+	routes := []Route{
+		{ListenAddr: "127.0.0.1:51950", ForwardAddr: listener.Addr().String(), Allow: []string{"10.0.0.0/8"}},
+		{ListenAddr: "127.0.0.1:51951", ForwardAddr: listener.Addr().String(), Allow: []string{"127.0.0.1"}, Deny: []string{"10.0.0.0/8"}},
+	}
+
+	var servers []*proxyServer
+	for _, route := range routes {
+		require.NoError(t, route.Validate())
+		server := NewProxyServer(ctx, route, log.Default(), false)
+		require.NoError(t, server.Bind())
+		defer server.Close()
+		go server.Serve()
+		servers = append(servers, server)
+	}
+
+	echo := func(addr string) error {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, make([]byte, 4))
+		return err
+	}
+
+	require.Error(t, echo("127.0.0.1:51950"))
+	require.NoError(t, echo("127.0.0.1:51951"))
+
+	require.Equal(t, int64(1), servers[0].access.denied.Load())
+	require.Equal(t, int64(1), servers[1].access.allowed.Load())
+
+	// behind load balancer the real client address is checked
+	route := Route{ListenAddr: "127.0.0.1:51953", ForwardAddr: listener.Addr().String(), Allow: []string{"192.0.2.0/24"}, AcceptProxy: &AcceptProxy{Trusted: []string{"127.0.0.1"}}}
+	require.NoError(t, route.Validate())
+	server := NewProxyServer(ctx, route, log.Default(), false)
+	require.NoError(t, server.Bind())
+	defer server.Close()
+	go server.Serve()
+
+	proxied := func(client string) error {
+		conn, err := net.Dial("tcp", "127.0.0.1:51953")
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("PROXY TCP4 " + client + " 127.0.0.1 50000 51953\r\nping")); err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, make([]byte, 4))
+		return err
+	}
+
+	require.NoError(t, proxied("192.0.2.10"))
+	require.Error(t, proxied("198.51.100.1"))
+	require.Equal(t, int64(1), server.access.denied.Load())
+
+	require.Error(t, Route{ListenAddr: "127.0.0.1:51952", ForwardAddr: "127.0.0.1:80", Deny: []string{"10.0.0"}}.Validate())
+}
@@ -0,0 +1,259 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const AccessLogJSON = "json"
+
+// side of the connection that closed it first
+const (
+	closedByClient  = "client"
+	closedByBackend = "backend"
+	closedByProxy   = "proxy"
+)
+
+// close reasons of access records
+const (
+	reasonEOF            = "eof"
+	reasonError          = "error"
+	reasonClientIdle     = "client_idle_timeout"
+	reasonUpstreamIdle   = "upstream_idle_timeout"
+	reasonSessionTimeout = "session_timeout"
+	reasonShutdown       = "shutdown"
+	reasonAdmin          = "admin"
+	reasonProxyHeader    = "proxy_header"
+	reasonAccess         = "access"
+	reasonDisabled       = "disabled"
+	reasonConnLimit      = "conn_limit"
+	reasonQueueTimeout   = "queue_timeout"
+	reasonRateLimit      = "rate_limit"
+	reasonHandshake      = "tls_handshake"
+	reasonServerName     = "server_name"
+	reasonNoBackend      = "no_backend"
+)
+
+// failed writes of access log are reported once per interval
+var accessLogErrorInterval = 10 * time.Second
+
+// accessRecord describes closed client connection or udp session, fields are available in text format
+type accessRecord struct {
+	ID          string    `json:"id"`
+	Route       string    `json:"route"`
+	Client      string    `json:"client"`
+	Backend     string    `json:"backend,omitempty"`
+	ServerName  string    `json:"server_name,omitempty"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Duration    Duration  `json:"duration"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	CloseReason string    `json:"close_reason"`
+	ClosedBy    string    `json:"closed_by"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// parseAccessFormat returns nil template for json format
+func parseAccessFormat(format string) (*template.Template, error) {
+	if format == "" || format == AccessLogJSON {
+		return nil, nil
+	}
+	tmpl, err := template.New("access_log").Parse(format)
+	if err != nil {
+		return nil, errors.Errorf("invalid access log format, %v", err)
+	}
+	// fields are checked once, so the wrong one does not fail every record
+	if err := tmpl.Execute(ioutil.Discard, accessRecord{}); err != nil {
+		return nil, errors.Errorf("invalid access log format, %v", err)
+	}
+	return tmpl, nil
+}
+
+// accessLog writes one line per closed connection separately from the daemon log
+type accessLog struct {
+	path string
+	tmpl *template.Template
+	log  *log.Logger
+
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+
+	sparse sparseLog
+}
+
+// openAccessLog opens file in append mode, stdout and stderr are the standard streams
+func openAccessLog(path, format string, log *log.Logger) (*accessLog, error) {
+
+	tmpl, err := parseAccessFormat(format)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &accessLog{path: path, tmpl: tmpl, log: log, sparse: sparseLog{interval: accessLogErrorInterval}}
+
+	switch path {
+	case "stdout":
+		t.w = os.Stdout
+	case "stderr":
+		t.w = os.Stderr
+	default:
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, errors.Errorf("fail to open access log '%s', %v", path, err)
+		}
+		t.w, t.closer = file, file
+	}
+	return t, nil
+}
+
+// reopen opens the file again after it is moved by logrotate, standard streams are kept
+func (t *accessLog) reopen() error {
+
+	if t.closer == nil {
+		return nil
+	}
+
+	file, err := os.OpenFile(t.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return errors.Errorf("fail to reopen access log '%s', %v", t.path, err)
+	}
+
+	t.mu.Lock()
+	closer := t.closer
+	t.w, t.closer = file, file
+	t.mu.Unlock()
+
+	return closer.Close()
+}
+
+func (t *accessLog) write(record *accessRecord) {
+
+	var buf bytes.Buffer
+	var err error
+	if t.tmpl != nil {
+		err = t.tmpl.Execute(&buf, record)
+		if err == nil && !strings.HasSuffix(buf.String(), "\n") {
+			buf.WriteByte('\n')
+		}
+	} else {
+		err = json.NewEncoder(&buf).Encode(record)
+	}
+
+	// record is written at once, so lines of concurrent connections never mix
+	if err == nil {
+		t.mu.Lock()
+		_, err = t.w.Write(buf.Bytes())
+		t.mu.Unlock()
+	}
+
+	if err != nil {
+		if skipped, ok := t.sparse.allow(); ok {
+			t.log.Printf("Access log write error, skipped %d messages, %v\n", skipped, err)
+		}
+	}
+}
+
+func (t *accessLog) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closer != nil {
+		return t.closer.Close()
+	}
+	return nil
+}
+
+// closing records the first side closing the connection and the reason, later calls are ignored
+func (t *connInfo) closing(by, reason string, err error) {
+	t.closeMu.Lock()
+	defer t.closeMu.Unlock()
+	if t.closedBy != "" {
+		return
+	}
+	t.closedBy, t.closeReason = by, reason
+	if err != nil {
+		t.closeErr = err.Error()
+	}
+}
+
+// logAccess writes record of the finished connection, connection ended without recorded side is closed by client
+// if it has no error
+func (t *proxyServer) logAccess(info *connInfo, err error) {
+
+	if err != nil {
+		info.closing(closedByProxy, reasonError, err)
+	} else {
+		info.closing(closedByClient, reasonEOF, nil)
+	}
+
+	if t.accessLog == nil {
+		return
+	}
+
+	end := time.Now()
+	info.closeMu.Lock()
+	closedBy, reason, closeErr := info.closedBy, info.closeReason, info.closeErr
+	info.closeMu.Unlock()
+
+	t.accessLog.write(&accessRecord{
+		ID:          info.id,
+		Route:       t.route.protocolPrefix() + t.listenAddr,
+		Client:      addrString(info.client),
+		Backend:     info.backend.Load(),
+		ServerName:  info.serverName,
+		Start:       info.start,
+		End:         end,
+		Duration:    Duration(end.Sub(info.start)),
+		BytesIn:     info.bytesIn.Load(),
+		BytesOut:    info.bytesOut.Load(),
+		CloseReason: reason,
+		ClosedBy:    closedBy,
+		Error:       closeErr,
+	})
+}
+
+// logRejected writes record of the client rejected right after accept
+func (t *proxyServer) logRejected(info *connInfo, reason string) {
+	info.closing(closedByProxy, reason, nil)
+	t.logAccess(info, nil)
+}
+
+func (t *udpServer) logAccess(session *udpSession, closedBy, reason string, err error) {
+
+	if t.accessLog == nil {
+		return
+	}
+
+	end := time.Now()
+	record := &accessRecord{
+		ID:          session.id,
+		Route:       t.route.protocolPrefix() + t.listenAddr,
+		Client:      session.client.String(),
+		Backend:     session.backend.addr,
+		Start:       session.start,
+		End:         end,
+		Duration:    Duration(end.Sub(session.start)),
+		BytesIn:     session.bytesIn.Load(),
+		BytesOut:    session.bytesOut.Load(),
+		CloseReason: reason,
+		ClosedBy:    closedBy,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	t.accessLog.write(record)
+}
@@ -0,0 +1,166 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessFormat(t *testing.T) {
+
+	for _, format := range []string{"", AccessLogJSON} {
+		tmpl, err := parseAccessFormat(format)
+		require.NoError(t, err)
+		require.Nil(t, tmpl)
+	}
+
+	for _, format := range []string{"{{.Client", "{{.Unknown}}"} {
+		_, err := parseAccessFormat(format)
+		require.Error(t, err, format)
+	}
+
+	tmpl, err := parseAccessFormat(`{{.ID}} {{.Client}} -> {{.Backend}} {{.BytesIn}}/{{.BytesOut}} {{.Duration}} {{.CloseReason}} by {{.ClosedBy}}`)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	access := &accessLog{tmpl: tmpl, log: log.Default(), w: &buf}
+	access.write(&accessRecord{ID: "a-1", Client: "192.0.2.10:50000", Backend: "10.0.0.5:80", BytesIn: 10, BytesOut: 20,
+		Duration: Duration(1500 * time.Millisecond), CloseReason: reasonEOF, ClosedBy: closedByClient})
+	require.Equal(t, "a-1 192.0.2.10:50000 -> 10.0.0.5:80 10/20 1.5s eof by client\n", buf.String())
+}
+
+func TestAccessLog(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// backend answers once and closes
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.CopyN(conn, conn, 4)
+			}()
+		}
+	}()
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	access, err := openAccessLog(path, AccessLogJSON, log.Default())
+	require.NoError(t, err)
+	defer access.Close()
+
+	route := Route{ListenAddr: "127.0.0.1:52250", ForwardAddr: listener.Addr().String(), ClientIdleTimeout: Duration(300 * time.Millisecond)}
+	proxyServer := NewProxyServer(ctx, route, log.Default(), false)
+	proxyServer.accessLog = access
+	require.NoError(t, proxyServer.Bind())
+	defer proxyServer.Close()
+	go proxyServer.Serve()
+
+	records := func(n int) []accessRecord {
+		var list []accessRecord
+		require.Eventually(t, func() bool {
+			content, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+			lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+			if len(lines) < n || lines[0] == "" {
+				return false
+			}
+			list = nil
+			for _, line := range lines {
+				var record accessRecord
+				require.NoError(t, json.Unmarshal([]byte(line), &record))
+				list = append(list, record)
+			}
+			return true
+		}, 5*time.Second, 10*time.Millisecond)
+		return list
+	}
+
+	// backend closes first after the answer
+	conn, err := net.Dial("tcp", "127.0.0.1:52250")
+	require.NoError(t, err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 4))
+	require.NoError(t, err)
+	client := conn.LocalAddr().String()
+	conn.Close()
+
+	record := records(1)[0]
+	require.Equal(t, "127.0.0.1:52250", record.Route)
+	require.Equal(t, client, record.Client)
+	require.Equal(t, listener.Addr().String(), record.Backend)
+	require.Equal(t, int64(4), record.BytesIn)
+	require.Equal(t, int64(4), record.BytesOut)
+	require.Equal(t, closedByBackend, record.ClosedBy)
+	require.Equal(t, reasonEOF, record.CloseReason)
+	require.False(t, record.End.Before(record.Start))
+
+	// silent client is closed by proxy
+	conn, err = net.Dial("tcp", "127.0.0.1:52250")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	record = records(2)[1]
+	require.Equal(t, closedByProxy, record.ClosedBy)
+	require.Equal(t, reasonClientIdle, record.CloseReason)
+	require.GreaterOrEqual(t, int64(record.Duration), int64(300*time.Millisecond))
+
+	// client rejected right after accept has the record too
+	proxyServer.setEnabled(false)
+	conn, err = net.Dial("tcp", "127.0.0.1:52250")
+	require.NoError(t, err)
+	defer conn.Close()
+	client = conn.LocalAddr().String()
+
+	record = records(3)[2]
+	require.Equal(t, client, record.Client)
+	require.Equal(t, closedByProxy, record.ClosedBy)
+	require.Equal(t, reasonDisabled, record.CloseReason)
+}
+
+func TestAccessLogReopen(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	access, err := openAccessLog(path, "{{.ID}}", log.Default())
+	require.NoError(t, err)
+	defer access.Close()
+
+	access.write(&accessRecord{ID: "a-1"})
+
+	// logrotate moves the file and sends SIGHUP
+	require.NoError(t, os.Rename(path, path+".1"))
+	require.NoError(t, access.reopen())
+	access.write(&accessRecord{ID: "a-2"})
+
+	content, err := ioutil.ReadFile(path + ".1")
+	require.NoError(t, err)
+	require.Equal(t, "a-1\n", string(content))
+
+	content, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "a-2\n", string(content))
+}
@@ -0,0 +1,369 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// routeState is the admin view of the route with its backends
+type routeState struct {
+	Route    string         `json:"route"`
+	Forward  string         `json:"forward"`
+	Enabled  bool           `json:"enabled"`
+	Accepted int64          `json:"accepted"`
+	Active   int64          `json:"active"`
+	Limit    *limitState    `json:"limit,omitempty"`
+	Backends []backendState `json:"backends"`
+}
+
+// limitState is the admin view of the connection limit of the route
+type limitState struct {
+	Max      int   `json:"max"`
+	Active   int64 `json:"active"`
+	Peak     int64 `json:"peak"`
+	Queued   int64 `json:"queued"`
+	Rejected int64 `json:"rejected"`
+}
+
+type backendState struct {
+	Addr         string `json:"addr"`
+	Up           bool   `json:"up"`
+	Breaker      string `json:"breaker"`
+	Active       int64  `json:"active"`
+	Total        int64  `json:"total"`
+	DialFailures int64  `json:"dial_failures"`
+	EarlyResets  int64  `json:"early_resets"`
+	BytesIn      int64  `json:"bytes_in"`
+	BytesOut     int64  `json:"bytes_out"`
+}
+
+// connState is the admin view of the active client connection or udp session
+type connState struct {
+	ID         string    `json:"id"`
+	Route      string    `json:"route"`
+	Client     string    `json:"client"`
+	Backend    string    `json:"backend,omitempty"`
+	ServerName string    `json:"server_name,omitempty"`
+	Start      time.Time `json:"start"`
+	Age        Duration  `json:"age"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+}
+
+func backendStates(backends []*backend) []backendState {
+	list := make([]backendState, 0, len(backends))
+	for _, b := range backends {
+		breaker := "disabled"
+		if b.breaker != nil {
+			breaker = b.breaker.State().String()
+		}
+		list = append(list, backendState{
+			Addr:         b.addr,
+			Up:           b.available(),
+			Breaker:      breaker,
+			Active:       b.active.Load(),
+			Total:        b.total.Load(),
+			DialFailures: b.dialFailures.Load(),
+			EarlyResets:  b.earlyResets.Load(),
+			BytesIn:      b.bytesIn.Load(),
+			BytesOut:     b.bytesOut.Load(),
+		})
+	}
+	return list
+}
+
+// meteredConn counts bytes of the client connection
+type meteredConn struct {
+	net.Conn
+	info *connInfo
+}
+
+func (t *meteredConn) Read(b []byte) (int, error) {
+	n, err := t.Conn.Read(b)
+	t.info.bytesIn.Add(int64(n))
+	return n, err
+}
+
+func (t *meteredConn) Write(b []byte) (int, error) {
+	n, err := t.Conn.Write(b)
+	t.info.bytesOut.Add(int64(n))
+	return n, err
+}
+
+func (t *proxyServer) track(conn *meteredConn) {
+	t.trackMu.Lock()
+	t.tracked[conn.info.id] = conn
+	t.trackMu.Unlock()
+}
+
+func (t *proxyServer) untrack(conn *meteredConn) {
+	t.trackMu.Lock()
+	delete(t.tracked, conn.info.id)
+	t.trackMu.Unlock()
+}
+
+func (t *proxyServer) state() routeState {
+	return routeState{
+		Route:    t.route.protocolPrefix() + t.listenAddr,
+		Forward:  t.forwardAddr,
+		Enabled:  !t.disabled.Load(),
+		Accepted: t.accepted.Load(),
+		Active:   t.active.Load(),
+		Backends: backendStates(t.backends()),
+		Limit:    limitStateOf(t.limiter),
+	}
+}
+
+func limitStateOf(limiter *connLimiter) *limitState {
+	if limiter == nil {
+		return nil
+	}
+	return &limitState{
+		Max:      limiter.max,
+		Active:   limiter.active.Load(),
+		Peak:     limiter.peak.Load(),
+		Queued:   limiter.queued.Load(),
+		Rejected: limiter.rejected.Load(),
+	}
+}
+
+func (t *proxyServer) connections() []connState {
+
+	t.trackMu.Lock()
+	list := make([]connState, 0, len(t.tracked))
+	for _, conn := range t.tracked {
+		info := conn.info
+		list = append(list, connState{
+			ID:         info.id,
+			Route:      t.route.protocolPrefix() + t.listenAddr,
+			Client:     addrString(info.client),
+			Backend:    info.backend.Load(),
+			ServerName: info.serverName,
+			Start:      info.start,
+			Age:        Duration(time.Since(info.start)),
+			BytesIn:    info.bytesIn.Load(),
+			BytesOut:   info.bytesOut.Load(),
+		})
+	}
+	t.trackMu.Unlock()
+
+	return list
+}
+
+func (t *proxyServer) closeConn(id string) bool {
+
+	t.trackMu.Lock()
+	conn, ok := t.tracked[id]
+	t.trackMu.Unlock()
+
+	if !ok {
+		return false
+	}
+	t.log.Printf("ProxyServe '%s' connection '%s' of client '%s' closed by admin\n", t.listenAddr, id, addrString(conn.info.client))
+	conn.info.closing(closedByProxy, reasonAdmin, nil)
+	conn.Close()
+	return true
+}
+
+func (t *proxyServer) setEnabled(enabled bool) {
+	if t.disabled.CAS(enabled, !enabled) {
+		t.log.Printf("ProxyServe '%s' enabled %v by admin\n", t.listenAddr, enabled)
+	}
+}
+
+func (t *udpServer) state() routeState {
+
+	t.mu.Lock()
+	active := len(t.sessions)
+	t.mu.Unlock()
+
+	return routeState{
+		Route:    t.route.protocolPrefix() + t.listenAddr,
+		Forward:  t.forwardAddr,
+		Enabled:  !t.disabled.Load(),
+		Accepted: t.accepted.Load(),
+		Active:   int64(active),
+		Backends: backendStates(t.upstream.backends),
+		Limit:    limitStateOf(t.limiter),
+	}
+}
+
+func (t *udpServer) connections() []connState {
+
+	t.mu.Lock()
+	list := make([]connState, 0, len(t.sessions))
+	for _, session := range t.sessions {
+		list = append(list, connState{
+			ID:       session.id,
+			Route:    t.route.protocolPrefix() + t.listenAddr,
+			Client:   session.client.String(),
+			Backend:  session.backend.addr,
+			Start:    session.start,
+			Age:      Duration(time.Since(session.start)),
+			BytesIn:  session.bytesIn.Load(),
+			BytesOut: session.bytesOut.Load(),
+		})
+	}
+	t.mu.Unlock()
+
+	return list
+}
+
+func (t *udpServer) closeConn(id string) bool {
+
+	var found *udpSession
+	t.mu.Lock()
+	for _, session := range t.sessions {
+		if session.id == id {
+			found = session
+			break
+		}
+	}
+	t.mu.Unlock()
+
+	if found == nil {
+		return false
+	}
+	t.log.Printf("UDPServe '%s' session '%s' of client '%s' closed by admin\n", t.listenAddr, id, found.client)
+	t.closeSession(found, closedByProxy, reasonAdmin, nil)
+	return true
+}
+
+func (t *udpServer) setEnabled(enabled bool) {
+	if t.disabled.CAS(enabled, !enabled) {
+		t.log.Printf("UDPServe '%s' enabled %v by admin\n", t.listenAddr, enabled)
+	}
+}
+
+// adminHandler serves admin api, every request needs bearer token if it is not empty
+func (t *proxyDaemon) adminHandler(token string) http.Handler {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/routes", t.serveRoutes)
+	mux.HandleFunc("/routes/enable", t.serveEnable(true))
+	mux.HandleFunc("/routes/disable", t.serveEnable(false))
+	mux.HandleFunc("/connections", t.serveConnections)
+	mux.HandleFunc("/connections/", t.serveCloseConn)
+
+	if token == "" {
+		return mux
+	}
+
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			adminError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func adminError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+func (t *proxyDaemon) writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		t.log.Printf("Admin write error, %v\n", err)
+	}
+}
+
+// findServer returns server of the route given as listen address with protocol prefix like udp/0.0.0.0:53
+func (t *proxyDaemon) findServer(route string) server {
+	for _, server := range t.serverList() {
+		if server.Route().protocolPrefix()+server.Route().ListenAddr == route {
+			return server
+		}
+	}
+	return nil
+}
+
+func (t *proxyDaemon) serveRoutes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	servers := sortServers(t.serverList())
+	list := make([]routeState, 0, len(servers))
+	for _, server := range servers {
+		list = append(list, server.state())
+	}
+	t.writeJSON(w, list)
+}
+
+// serveEnable enables or disables route of the query parameter, disabled route closes new connections at once
+// and keeps the active ones
+func (t *proxyDaemon) serveEnable(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		server := t.findServer(r.URL.Query().Get("route"))
+		if server == nil {
+			adminError(w, http.StatusNotFound, "route not found")
+			return
+		}
+		server.setEnabled(enabled)
+		t.writeJSON(w, server.state())
+	}
+}
+
+// serveConnections lists active connections of all routes or of the route of the query parameter, oldest first
+func (t *proxyDaemon) serveConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	servers := t.serverList()
+	if route := r.URL.Query().Get("route"); route != "" {
+		found := t.findServer(route)
+		if found == nil {
+			adminError(w, http.StatusNotFound, "route not found")
+			return
+		}
+		servers = []server{found}
+	}
+
+	list := []connState{}
+	for _, server := range servers {
+		list = append(list, server.connections()...)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Start.Before(list[j].Start)
+	})
+	t.writeJSON(w, list)
+}
+
+// serveCloseConn closes connection by DELETE /connections/<id>
+func (t *proxyDaemon) serveCloseConn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/connections/")
+	for _, server := range t.serverList() {
+		if server.closeConn(id) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	adminError(w, http.StatusNotFound, "connection not found")
+}
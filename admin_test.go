@@ -0,0 +1,127 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAdmin(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// backend echoes until client closes
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	route := Route{ListenAddr: "127.0.0.1:52150", ForwardAddr: listener.Addr().String()}
+	proxyServer := NewProxyServer(ctx, route, log.Default(), false)
+	require.NoError(t, proxyServer.Bind())
+	defer proxyServer.Close()
+	go proxyServer.Serve()
+
+	daemon := &proxyDaemon{ctx: ctx, log: log.Default(), servers: map[string]server{routeKey(route): proxyServer}}
+	require.NoError(t, daemon.listenHTTP(ctx, "Admin", "127.0.0.1:52151", daemon.adminHandler("secret")))
+
+	call := func(method, path string, token string, result interface{}) int {
+		req, err := http.NewRequest(method, "http://127.0.0.1:52151"+path, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		if result != nil && resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(result))
+		}
+		return resp.StatusCode
+	}
+
+	echo := func() (net.Conn, error) {
+		conn, err := net.Dial("tcp", "127.0.0.1:52150")
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	require.Equal(t, http.StatusUnauthorized, call("GET", "/connections", "", nil))
+	require.Equal(t, http.StatusUnauthorized, call("GET", "/connections", "wrong", nil))
+
+	conn, err := echo()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var conns []connState
+	require.Equal(t, http.StatusOK, call("GET", "/connections", "secret", &conns))
+	require.Equal(t, 1, len(conns))
+	require.Equal(t, "127.0.0.1:52150", conns[0].Route)
+	require.Equal(t, conn.LocalAddr().String(), conns[0].Client)
+	require.Equal(t, listener.Addr().String(), conns[0].Backend)
+	require.Equal(t, int64(4), conns[0].BytesIn)
+	require.Equal(t, int64(4), conns[0].BytesOut)
+
+	// closed connection ends relay for client
+	require.Equal(t, http.StatusNoContent, call("DELETE", "/connections/"+conns[0].ID, "secret", nil))
+	require.Equal(t, http.StatusNotFound, call("DELETE", "/connections/"+conns[0].ID, "secret", nil))
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+
+	var state routeState
+	require.Equal(t, http.StatusOK, call("POST", "/routes/disable?route=127.0.0.1:52150", "secret", &state))
+	require.False(t, state.Enabled)
+	_, err = echo()
+	require.Error(t, err)
+	require.Equal(t, int64(1), proxyServer.refused.Load())
+
+	require.Equal(t, http.StatusOK, call("POST", "/routes/enable?route=127.0.0.1:52150", "secret", &state))
+	require.True(t, state.Enabled)
+	conn, err = echo()
+	require.NoError(t, err)
+	conn.Close()
+
+	var routes []routeState
+	require.Equal(t, http.StatusOK, call("GET", "/routes", "secret", &routes))
+	require.Equal(t, 1, len(routes))
+	require.Equal(t, int64(3), routes[0].Accepted)
+	require.Equal(t, 1, len(routes[0].Backends))
+	require.Equal(t, int64(2), routes[0].Backends[0].Total)
+
+	require.Equal(t, http.StatusNotFound, call("POST", "/routes/disable?route=127.0.0.1:1", "secret", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, call("GET", "/routes/disable?route=127.0.0.1:52150", "secret", nil))
+}
@@ -0,0 +1,336 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ByteRate is bytes per second written in config files as "512K", "10M", "1G" in bytes or "100mbit" in bits,
+// plain numbers are bytes
+type ByteRate int64
+
+var byteRateUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"gbit", 1e9 / 8}, {"mbit", 1e6 / 8}, {"kbit", 1e3 / 8},
+	{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+	{"g", 1 << 30}, {"m", 1 << 20}, {"k", 1 << 10},
+	{"b", 1},
+}
+
+func ParseByteRate(s string) (ByteRate, error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	scale := 1.0
+	for _, unit := range byteRateUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value, scale = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix)), unit.scale
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("invalid byte rate '%s'", s)
+	}
+	return ByteRate(n * scale), nil
+}
+
+func (t ByteRate) String() string {
+	for _, unit := range []struct {
+		suffix string
+		size   ByteRate
+	}{{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if t >= unit.size && t%unit.size == 0 {
+			return strconv.FormatInt(int64(t/unit.size), 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(t), 10)
+}
+
+func (t ByteRate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+func (t *ByteRate) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	return t.set(value)
+}
+
+func (t ByteRate) MarshalYAML() (interface{}, error) {
+	return t.String(), nil
+}
+
+func (t *ByteRate) UnmarshalYAML(node *yaml.Node) error {
+	var value interface{}
+	if err := node.Decode(&value); err != nil {
+		return err
+	}
+	return t.set(value)
+}
+
+func (t *ByteRate) set(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		rate, err := ParseByteRate(v)
+		if err != nil {
+			return err
+		}
+		*t = rate
+	case int:
+		*t = ByteRate(v)
+	case float64:
+		*t = ByteRate(v)
+	default:
+		return errors.Errorf("invalid byte rate '%v'", value)
+	}
+	return nil
+}
+
+// Bandwidth limits upload from clients and download to them, unlimited if empty,
+// aggregate limits of the client address and the route are shared by its active connections
+type Bandwidth struct {
+	Upload   ByteRate `json:"upload,omitempty" yaml:"upload,omitempty"`
+	Download ByteRate `json:"download,omitempty" yaml:"download,omitempty"`
+
+	ClientUpload   ByteRate `json:"client_upload,omitempty" yaml:"client_upload,omitempty"`
+	ClientDownload ByteRate `json:"client_download,omitempty" yaml:"client_download,omitempty"`
+
+	RouteUpload   ByteRate `json:"route_upload,omitempty" yaml:"route_upload,omitempty"`
+	RouteDownload ByteRate `json:"route_download,omitempty" yaml:"route_download,omitempty"`
+}
+
+func (t *Bandwidth) Validate() error {
+	if t.Upload < 0 || t.Download < 0 || t.ClientUpload < 0 || t.ClientDownload < 0 || t.RouteUpload < 0 || t.RouteDownload < 0 {
+		return errors.New("negative bandwidth")
+	}
+	return nil
+}
+
+const (
+	// connections transfer by chunks, so busy ones take turns in shared buckets
+	minShapeChunk = 512
+	maxShapeChunk = 16 << 10
+)
+
+// rateBucket is token bucket of bytes, reservations take tokens in advance
+// and wait until the bucket refills, so waiting connections are served in turn
+type rateBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newRateBucket returns bucket of the rate, nil if rate is unlimited
+func newRateBucket(rate ByteRate) *rateBucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := math.Max(float64(rate)/10, maxShapeChunk)
+	return &rateBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes n bytes and returns time to wait before sending them
+func (t *rateBucket) reserve(n int) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.tokens = math.Min(t.burst, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+	t.tokens -= float64(n)
+
+	if t.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-t.tokens / t.rate * float64(time.Second))
+}
+
+// reserveAll waits for n bytes in all buckets, fails if context is done while waiting
+func reserveAll(ctx context.Context, buckets []*rateBucket, n int) error {
+	var wait time.Duration
+	for _, b := range buckets {
+		if d := b.reserve(n); d > wait {
+			wait = d
+		}
+	}
+	if wait == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <- timer.C:
+		return nil
+	case <- ctx.Done():
+		return net.ErrClosed
+	}
+}
+
+// clientShape is aggregate buckets of the client address
+type clientShape struct {
+	upload   *rateBucket
+	download *rateBucket
+	refs     int
+}
+
+// shaper holds aggregate buckets of the route and of its clients
+type shaper struct {
+	conf Bandwidth
+
+	upload   *rateBucket
+	download *rateBucket
+
+	mu      sync.Mutex
+	clients map[string]*clientShape
+}
+
+func newShaper(conf Bandwidth) *shaper {
+	return &shaper{
+		conf:     conf,
+		upload:   newRateBucket(conf.RouteUpload),
+		download: newRateBucket(conf.RouteDownload),
+		clients:  make(map[string]*clientShape),
+	}
+}
+
+// wrap limits bandwidth of the client connection, shaped connection releases client buckets by release,
+// waits end on close, release or done context
+func (t *shaper) wrap(ctx context.Context, conn net.Conn) *shapedConn {
+
+	c := &shapedConn{Conn: conn, shaper: t, client: clientIP(conn.RemoteAddr())}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+
+	var client *clientShape
+	if t.conf.ClientUpload > 0 || t.conf.ClientDownload > 0 {
+		t.mu.Lock()
+		client = t.clients[c.client]
+		if client == nil {
+			client = &clientShape{upload: newRateBucket(t.conf.ClientUpload), download: newRateBucket(t.conf.ClientDownload)}
+			t.clients[c.client] = client
+		}
+		client.refs++
+		t.mu.Unlock()
+		c.shared = true
+	}
+
+	for _, b := range []*rateBucket{newRateBucket(t.conf.Upload), t.upload} {
+		if b != nil {
+			c.upload = append(c.upload, b)
+		}
+	}
+	for _, b := range []*rateBucket{newRateBucket(t.conf.Download), t.download} {
+		if b != nil {
+			c.download = append(c.download, b)
+		}
+	}
+	if client != nil && client.upload != nil {
+		c.upload = append(c.upload, client.upload)
+	}
+	if client != nil && client.download != nil {
+		c.download = append(c.download, client.download)
+	}
+
+	c.chunk = maxShapeChunk
+	for _, b := range append(c.upload[:len(c.upload):len(c.upload)], c.download...) {
+		if chunk := int(b.rate / 20); chunk < c.chunk {
+			c.chunk = chunk
+		}
+	}
+	if c.chunk < minShapeChunk {
+		c.chunk = minShapeChunk
+	}
+
+	return c
+}
+
+// shapedConn waits for upload buckets after reads and for download buckets before writes
+type shapedConn struct {
+	net.Conn
+	shaper *shaper
+	client string
+	shared bool
+
+	upload   []*rateBucket
+	download []*rateBucket
+	chunk    int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	releaseOnce sync.Once
+}
+
+func (t *shapedConn) Read(p []byte) (int, error) {
+	if len(p) > t.chunk {
+		p = p[:t.chunk]
+	}
+	n, err := t.Conn.Read(p)
+	if n > 0 {
+		if werr := reserveAll(t.ctx, t.upload, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (t *shapedConn) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := len(p)
+		if n > t.chunk {
+			n = t.chunk
+		}
+		if err := reserveAll(t.ctx, t.download, n); err != nil {
+			return written, err
+		}
+		w, err := t.Conn.Write(p[:n])
+		written += w
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (t *shapedConn) Close() error {
+	t.cancel()
+	return t.Conn.Close()
+}
+
+// release returns client buckets, the last connection of the client removes them
+func (t *shapedConn) release() {
+	t.cancel()
+	if !t.shared {
+		return
+	}
+	t.releaseOnce.Do(func() {
+		t.shaper.mu.Lock()
+		defer t.shaper.mu.Unlock()
+		if client := t.shaper.clients[t.client]; client != nil {
+			if client.refs--; client.refs == 0 {
+				delete(t.shaper.clients, t.client)
+			}
+		}
+	})
+}
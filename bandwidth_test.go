@@ -0,0 +1,187 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestByteRate(t *testing.T) {
+
+	for s, expected := range map[string]ByteRate{
+		"1000":    1000,
+		"512K":    512 << 10,
+		"10mb":    10 << 20,
+		"1G":      1 << 30,
+		"100mbit": 12500000,
+		"1.5k":    1536,
+	} {
+		rate, err := ParseByteRate(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, rate, s)
+	}
+
+	for _, s := range []string{"", "fast", "-1M", "10x"} {
+		_, err := ParseByteRate(s)
+		require.Error(t, err, s)
+	}
+
+	require.Equal(t, "512K", ByteRate(512<<10).String())
+	require.Equal(t, "1536", ByteRate(1536).String())
+}
+
+func TestShaper(t *testing.T) {
+
+	shaper := newShaper(Bandwidth{Download: 1 << 20, ClientDownload: 2 << 20, RouteUpload: 4 << 20})
+
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 50000}
+	first := shaper.wrap(context.Background(), &proxiedConn{remote: client})
+	second := shaper.wrap(context.Background(), &proxiedConn{remote: client})
+
+	// connections of the same client share client bucket, all share route bucket
+	require.Equal(t, 2, len(first.download))
+	require.Same(t, first.download[1], second.download[1])
+	require.NotSame(t, first.download[0], second.download[0])
+	require.Equal(t, 1, len(first.upload))
+	require.Same(t, first.upload[0], second.upload[0])
+
+	first.release()
+	first.release()
+	require.Equal(t, 1, shaper.clients["192.0.2.10"].refs)
+	second.release()
+	require.Empty(t, shaper.clients)
+}
+
+func TestBandwidth(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	data := bytes.Repeat([]byte("x"), 64<<10)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write(data)
+			}()
+		}
+	}()
+
+	route := Route{ListenAddr: "127.0.0.1:51850", ForwardAddr: listener.Addr().String(), Bandwidth: &Bandwidth{Download: 64 << 10}}
+	require.NoError(t, route.Validate())
+
+	server := NewProxyServer(ctx, route, log.Default(), false)
+	require.NoError(t, server.Bind())
+	defer server.Close()
+	go server.Serve()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:51850")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := make([]byte, len(data))
+	_, err = io.ReadFull(conn, received)
+	require.NoError(t, err)
+
+	// burst of 16K goes at once, the rest at 64K per second
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(600*time.Millisecond))
+	require.Equal(t, data, received)
+}
+
+func TestShapedClose(t *testing.T) {
+
+	shaper := newShaper(Bandwidth{Download: 1 << 10})
+
+	client, proxied := net.Pipe()
+	defer client.Close()
+	go io.Copy(ioutil.Discard, client)
+
+	shaped := shaper.wrap(context.Background(), proxied)
+	defer shaped.release()
+
+	// the second chunk waits for the bucket until connection is closed
+	written := make(chan error, 1)
+	go func() {
+		_, err := shaped.Write(make([]byte, 64<<10))
+		written <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, shaped.Close())
+
+	select {
+	case err := <-written:
+		require.True(t, errors.Is(err, net.ErrClosed))
+	case <-time.After(time.Second):
+		t.Fatal("write is not interrupted by close")
+	}
+}
+
+func TestBandwidthShutdown(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write(make([]byte, 1<<20))
+			}()
+		}
+	}()
+
+	route := Route{ListenAddr: "127.0.0.1:51851", ForwardAddr: listener.Addr().String(), Bandwidth: &Bandwidth{Download: 16 << 10, Upload: 16 << 10}}
+	server := NewProxyServer(ctx, route, log.Default(), false)
+	require.NoError(t, server.Bind())
+	defer server.Close()
+	go server.Serve()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:51851")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, make([]byte, 1024))
+	require.NoError(t, err)
+	go conn.Write(make([]byte, 64<<10))
+
+	// shaped copies waiting for buckets end with the relay on shutdown
+	cancel()
+	_, err = io.Copy(ioutil.Discard, conn)
+	if netErr, ok := err.(net.Error); ok {
+		require.False(t, netErr.Timeout())
+	}
+	require.Eventually(t, func() bool { return server.active.Load() == 0 }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+}
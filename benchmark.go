@@ -18,10 +18,10 @@ import (
 	"time"
 )
 
-func RunSocketBenchmarkTest(ip string, forward ForwardPort, runProxy bool, bs, count int) error {
+func RunSocketBenchmarkTest(route Route, runProxy bool, bs, count int) error {
 
-	listenAddr := fmt.Sprintf("%s:%d", ip, forward.SrcPort)
-	forwardAddr := fmt.Sprintf("%s:%d", ip, forward.DstPort)
+	listenAddr := route.ListenAddr
+	forwardAddr := route.ForwardAddr
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -36,7 +36,7 @@ func RunSocketBenchmarkTest(ip string, forward ForwardPort, runProxy bool, bs, c
 	go echo.Serve()
 
 	if runProxy {
-		go RunProxy(ctx, ip, []ForwardPort{forward}, log.Default(), false)
+		go RunProxy(ctx, &Config{Routes: []Route{route}}, nil, log.Default())
 	}
 
 	time.Sleep(time.Millisecond)
@@ -103,10 +103,10 @@ func runSocketBenchmark(ctx context.Context, listenAddr string, bs, count int) e
 
 }
 
-func RunHttpBenchmarkTest(ip string, forward ForwardPort, runProxy bool,  bs, count int) error {
+func RunHttpBenchmarkTest(route Route, runProxy bool,  bs, count int) error {
 
-	listenAddr := fmt.Sprintf("%s:%d", ip, forward.SrcPort)
-	forwardAddr := fmt.Sprintf("%s:%d", ip, forward.DstPort)
+	listenAddr := route.ListenAddr
+	forwardAddr := route.ForwardAddr
 
 	server := &http.Server{
 		Addr:    forwardAddr,
@@ -120,7 +120,7 @@ func RunHttpBenchmarkTest(ip string, forward ForwardPort, runProxy bool,  bs, co
 	defer cancel()
 
 	if runProxy {
-		go RunProxy(ctx, ip, []ForwardPort{forward}, log.Default(), false)
+		go RunProxy(ctx, &Config{Routes: []Route{route}}, nil, log.Default())
 	}
 
 	time.Sleep(time.Millisecond)
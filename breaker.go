@@ -0,0 +1,158 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+var (
+	DefaultBreakerFailures    = 5
+	DefaultBreakerEjection    = Duration(10 * time.Second)
+	DefaultBreakerMaxEjection = Duration(5 * time.Minute)
+)
+
+// CircuitBreaker ejects backend after consecutive dial failures or early resets,
+// every next ejection is twice longer up to the max ejection
+type CircuitBreaker struct {
+	Failures    int      `json:"failures,omitempty" yaml:"failures,omitempty"`
+	Ejection    Duration `json:"ejection,omitempty" yaml:"ejection,omitempty"`
+	MaxEjection Duration `json:"max_ejection,omitempty" yaml:"max_ejection,omitempty"`
+}
+
+func (t *CircuitBreaker) Validate() error {
+	if t.Failures < 0 || t.Ejection < 0 || t.MaxEjection < 0 {
+		return errors.New("negative circuit breaker settings")
+	}
+	return nil
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (t breakerState) String() string {
+	switch t {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+type breaker struct {
+	failuresToEject int
+	ejection        time.Duration
+	maxEjection     time.Duration
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	ejections int
+	until     time.Time
+}
+
+func newBreaker(conf CircuitBreaker) *breaker {
+	t := &breaker{
+		failuresToEject: conf.Failures,
+		ejection:        time.Duration(conf.Ejection),
+		maxEjection:     time.Duration(conf.MaxEjection),
+	}
+	if t.failuresToEject == 0 {
+		t.failuresToEject = DefaultBreakerFailures
+	}
+	if t.ejection == 0 {
+		t.ejection = time.Duration(DefaultBreakerEjection)
+	}
+	if t.maxEjection == 0 {
+		t.maxEjection = time.Duration(DefaultBreakerMaxEjection)
+	}
+	return t
+}
+
+func (t *breaker) State() breakerState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+// ready is true when backend could be chosen, it does not take the half-open trial
+func (t *breaker) ready() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state == breakerClosed || (t.state == breakerOpen && !time.Now().Before(t.until))
+}
+
+// acquire takes the trial connection of ejected backend after ejection time
+func (t *breaker) acquire() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch t.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if time.Now().Before(t.until) {
+			return false
+		}
+		t.state = breakerHalfOpen
+		return true
+	default:
+		// trial is in progress
+		return false
+	}
+}
+
+// success closes breaker, returns true if backend was ejected before
+func (t *breaker) success() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == breakerOpen {
+		// connections started before ejection, only the trial restores backend
+		return false
+	}
+	restored := t.state != breakerClosed
+	t.state = breakerClosed
+	t.failures = 0
+	t.ejections = 0
+	return restored
+}
+
+// failure returns ejection time if backend was ejected by this failure
+func (t *breaker) failure() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.state == breakerOpen {
+		// connections started before ejection
+		return 0
+	}
+
+	t.failures++
+	if t.state != breakerHalfOpen && t.failures < t.failuresToEject {
+		return 0
+	}
+
+	ejection := t.ejection
+	for i := 0; i < t.ejections && ejection < t.maxEjection; i++ {
+		ejection *= 2
+	}
+	if ejection > t.maxEjection {
+		ejection = t.maxEjection
+	}
+
+	t.state = breakerOpen
+	t.ejections++
+	t.failures = 0
+	t.until = time.Now().Add(ejection)
+	return ejection
+}
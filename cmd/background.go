@@ -9,29 +9,32 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 )
 
-func startBackground() error {
+// startBackground runs the same command line in foreground mode as a daemon process
+func startBackground(cmdArgs []string, logConfigured bool) error {
 
 	executable, err := os.Executable()
 	if err != nil {
 		return err
 	}
 
-	args := []string{
-		"-f",
-		"-ip", *ListenIP,
-		"-log", executable + ".log",
-		"-srt", *ReadTimeout,
-		"-swt", *WriteTimeout,
-	}
+	args := []string{"-f"}
 
-	for _, portForward := range Ports {
-		args = append(args, "-p", fmt.Sprintf("%d:%d", portForward.SrcPort, portForward.DstPort))
+	if !logConfigured {
+		args = append(args, "-log", executable + ".log")
 	}
 
-	if *Verbose {
-		args = append(args, "-v")
+	args = append(args, cmdArgs...)
+
+	if *ConfigFile != "" {
+		// daemon reads the config again, so make sure that it finds the same file
+		configFile, err := filepath.Abs(*ConfigFile)
+		if err != nil {
+			return err
+		}
+		args = append(args, "-config", configFile)
 	}
 
 	cmd := exec.Command(executable, args...)
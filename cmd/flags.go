@@ -8,18 +8,27 @@ import (
 	"flag"
 	proxy "github.com/antihosting/tcp-proxy"
 	"github.com/pkg/errors"
-	"strconv"
-	"strings"
+	"time"
 )
 
-type ForwardPortFlags []proxy.ForwardPort
+type ForwardPortFlags []proxy.Route
 
 var (
+	ConfigFile = flag.String("config", "", "Config file with routes and settings in YAML or JSON format, flags override it")
+
 	Ports  ForwardPortFlags
-	ListenIP = flag.String("ip", "0.0.0.0", "Listen/forward ip address, example '0.0.0.0' or '127.0.0.1'")
+	ListenIP = flag.String("ip", "0.0.0.0", "Default listen/forward ip address for routes without one, example '0.0.0.0', '127.0.0.1' or '::1'")
+
+	ClientIdleTimeout = flag.String("cit", "5m", "Client connection idle timeout")
+	UpstreamIdleTimeout = flag.String("uit", "5m", "Upstream connection idle timeout")
+	HandshakeTimeout = flag.String("sht", "10s", "TLS handshake and ClientHello timeout")
+	ReadTimeout = flag.String("srt", "", "Deprecated, sets client and upstream idle timeouts")
+	WriteTimeout = flag.String("swt", "", "Deprecated, sets client and upstream idle timeouts")
+	DialTimeout = flag.String("sdt", "10s", "Upstream dial timeout")
+	SessionTimeout = flag.String("sst", "1m", "UDP session idle timeout")
 
-	ReadTimeout = flag.String("srt", "30s", "Socket read timeout")
-	WriteTimeout = flag.String("swt", "30s", "Socket write timeout")
+	Metrics = flag.String("metrics", "", "Listen address of prometheus /metrics endpoint like 127.0.0.1:9100 or unix:/run/port_proxy.sock")
+	Admin = flag.String("admin", "", "Listen address of admin api like 127.0.0.1:9101 or unix:/run/port_proxy_admin.sock")
 
 	BenchmarkTest  = flag.String("b", "", "Run benchmark test [http, socket]")
 	BenchmarkSize  = flag.Int("bs", 1 << 20, "Batch size")
@@ -28,31 +37,134 @@ var (
 	Verbose    = flag.Bool("v", false, "Print logs and debug information")
 	Foreground = flag.Bool("f", false, "Indicator that proxy is running in foreground")
 	LogFile    = flag.String("log", "stdout", "Write log to file")
+	AccessLogFile = flag.String("access-log", "", "Write records of closed connections to file, stdout or stderr")
+	AccessLogFormat = flag.String("access-log-format", "json", "Access log format, json or text/template of record fields like '{{.Client}} {{.Backend}} {{.Duration}}'")
 )
 
 func init() {
-	flag.CommandLine.Var(&Ports, "p", "Forward ports in format src:dst repeatable")
+	flag.CommandLine.Var(&Ports, "p", "Forward ports in format [udp/][listenip:]src:[host:]dst repeatable, src and dst could be ranges 30000-30099")
 }
 
 func (f *ForwardPortFlags) String() string {
-	return "Forward ports in format src:dst repeatable"
+	return "Forward ports in format [udp/][listenip:]src:[host:]dst repeatable, src and dst could be ranges 30000-30099"
 }
 
 func (f *ForwardPortFlags) Set(value string) error {
-	i := strings.IndexByte(value, ':')
-	if i == -1 {
-		return errors.Errorf("separator ':' not found in '%s'", value)
-	}
-	src, err := strconv.ParseInt(value[:i], 10, 32)
+	route, err := proxy.ParseRoute(value)
 	if err != nil {
-		return errors.Errorf("parsing of first part '%s' of '%s' was failed with error %v", value[:i], value, err)
+		return err
 	}
-	dst, err := strconv.ParseInt(value[i+1:], 10, 32)
+	routes, err := route.Expand()
 	if err != nil {
-		return errors.Errorf("parsing of second part '%s' of '%s' was failed with error %v", value[i+1:], value, err)
+		return err
 	}
-	*f = append(*f, proxy.ForwardPort{ SrcPort: int(src), DstPort: int(dst) } )
+	*f = append(*f, routes...)
 	return nil
 }
 
+func isFlagSet(name string) bool {
+	found := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
+
+// applyFlags overrides config settings by flags set in command line and
+// fills settings missing in config by flag defaults, except log that is stdout by default
+func applyFlags(conf *proxy.Config) error {
+
+	if isFlagSet("ip") || conf.IP == "" {
+		conf.IP = *ListenIP
+	}
+
+	if isFlagSet("log") {
+		conf.Log = *LogFile
+	}
+
+	if isFlagSet("access-log") {
+		conf.AccessLog = *AccessLogFile
+	}
 
+	if isFlagSet("access-log-format") {
+		conf.AccessLogFormat = *AccessLogFormat
+	}
+
+	if isFlagSet("v") {
+		conf.Verbose = *Verbose
+	}
+
+	if isFlagSet("metrics") {
+		conf.Metrics = *Metrics
+	}
+
+	if isFlagSet("admin") {
+		conf.Admin = *Admin
+	}
+
+	if isFlagSet("cit") || conf.ClientIdleTimeout == 0 {
+		d, err := time.ParseDuration(*ClientIdleTimeout)
+		if err != nil {
+			return errors.Errorf("incorrect client idle timeout '%s', %v", *ClientIdleTimeout, err)
+		}
+		conf.ClientIdleTimeout = proxy.Duration(d)
+	}
+
+	if isFlagSet("uit") || conf.UpstreamIdleTimeout == 0 {
+		d, err := time.ParseDuration(*UpstreamIdleTimeout)
+		if err != nil {
+			return errors.Errorf("incorrect upstream idle timeout '%s', %v", *UpstreamIdleTimeout, err)
+		}
+		conf.UpstreamIdleTimeout = proxy.Duration(d)
+	}
+
+	// former absolute socket timeouts set idle timeouts not given by own flags, the longer one wins
+	var legacy proxy.Duration
+	for _, value := range []string{*ReadTimeout, *WriteTimeout} {
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.Errorf("incorrect socket timeout '%s', %v", value, err)
+		}
+		if proxy.Duration(d) > legacy {
+			legacy = proxy.Duration(d)
+		}
+	}
+	if legacy > 0 && !isFlagSet("cit") {
+		conf.ClientIdleTimeout = legacy
+	}
+	if legacy > 0 && !isFlagSet("uit") {
+		conf.UpstreamIdleTimeout = legacy
+	}
+
+	if isFlagSet("sht") || conf.HandshakeTimeout == 0 {
+		d, err := time.ParseDuration(*HandshakeTimeout)
+		if err != nil {
+			return errors.Errorf("incorrect handshake timeout '%s', %v", *HandshakeTimeout, err)
+		}
+		conf.HandshakeTimeout = proxy.Duration(d)
+	}
+
+	if isFlagSet("sdt") || conf.DialTimeout == 0 {
+		d, err := time.ParseDuration(*DialTimeout)
+		if err != nil {
+			return errors.Errorf("incorrect dial timeout '%s', %v", *DialTimeout, err)
+		}
+		conf.DialTimeout = proxy.Duration(d)
+	}
+
+	if isFlagSet("sst") || conf.SessionTimeout == 0 {
+		d, err := time.ParseDuration(*SessionTimeout)
+		if err != nil {
+			return errors.Errorf("incorrect session timeout '%s', %v", *SessionTimeout, err)
+		}
+		conf.SessionTimeout = proxy.Duration(d)
+	}
+
+	conf.Routes = append(conf.Routes, Ports...)
+	return nil
+}
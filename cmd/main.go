@@ -15,7 +15,6 @@ import (
 	"os"
 	rt "runtime"
 	"strings"
-	"time"
 )
 
 var (
@@ -54,45 +53,36 @@ func doRun(args []string) error {
 
 	flag.CommandLine.Parse(args)
 
-	if len(Ports) == 0 {
-		return errors.New("empty forward ports")
-	}
-
-	readTimeout, err := time.ParseDuration(*ReadTimeout)
-	if err != nil {
-		return errors.Errorf("incorrect read timeout '%s', %v", *ReadTimeout, err)
-	}
-
-	writeTimeout, err := time.ParseDuration(*WriteTimeout)
+	conf, err := loadConfig()
 	if err != nil {
-		return errors.Errorf("incorrect write timeout '%s', %v", *WriteTimeout, err)
+		return err
 	}
 
 	withProxy := strings.HasSuffix(*BenchmarkTest, "proxy")
 
 	if strings.HasPrefix(*BenchmarkTest, "http") {
-		return proxy.RunHttpBenchmarkTest(*ListenIP, Ports[0], withProxy, *BenchmarkSize, *Count)
+		return proxy.RunHttpBenchmarkTest(conf.Routes[0], withProxy, *BenchmarkSize, *Count)
 	}
 
 	if strings.HasPrefix(*BenchmarkTest, "socket") {
-		return proxy.RunSocketBenchmarkTest(*ListenIP, Ports[0], withProxy, *BenchmarkSize, *Count)
+		return proxy.RunSocketBenchmarkTest(conf.Routes[0], withProxy, *BenchmarkSize, *Count)
 	}
 
 	if !*Foreground {
 		// fork the process to run in background
-		return startBackground()
+		return startBackground(args, conf.Log != "")
 	}
 
 	var logFile *os.File
 	var logWriter io.Writer
 
-	if *LogFile == "stdout" {
+	if conf.Log == "" || conf.Log == "stdout" {
 		logWriter = os.Stdout
 	} else {
 		var err error
-		logFile, err = os.OpenFile(*LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		logFile, err = os.OpenFile(conf.Log, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 		if err != nil {
-			return errors.Errorf("fail to open file '%s', %v", *LogFile, err)
+			return errors.Errorf("fail to open file '%s', %v", conf.Log, err)
 		}
 		logWriter = logFile
 	}
@@ -107,13 +97,36 @@ func doRun(args []string) error {
 		log.Ldate|log.Ltime|log.Lshortfile)
 
 	log.Printf("%s %s %s\n", Exec, Version, Build)
-	log.Printf("Listen IP Address: %s\n", *ListenIP)
-	log.Printf("Forward Ports: %+v\n", Ports)
-	log.Printf("Verbose: %v\n", *Verbose)
+	if *ConfigFile != "" {
+		log.Printf("Config File: %s\n", *ConfigFile)
+	}
+	log.Printf("Default IP Address: %s\n", conf.IP)
+	log.Printf("Forward Ports: %s\n", proxy.FormatRoutes(conf.Routes))
+	log.Printf("Verbose: %v\n", conf.Verbose)
+
+	return proxy.RunProxy(context.Background(), conf, loadConfig, log)
+}
+
+// loadConfig reads config file if any and applies command line flags, called again on SIGHUP
+func loadConfig() (*proxy.Config, error) {
 
-	ctx := context.WithValue(context.Background(), proxy.ReadTimeoutKey{}, readTimeout)
-	ctx = context.WithValue(context.Background(), proxy.WriteTimeoutKey{}, writeTimeout)
+	conf := new(proxy.Config)
+	if *ConfigFile != "" {
+		var err error
+		conf, err = proxy.LoadConfig(*ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyFlags(conf); err != nil {
+		return nil, err
+	}
+
+	if err := conf.Normalize(); err != nil {
+		return nil, err
+	}
 
-	return proxy.RunProxy(ctx, *ListenIP, Ports, log, *Verbose)
+	return conf, nil
 }
 
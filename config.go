@@ -0,0 +1,206 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var DefaultDrainTimeout = Duration(time.Minute)
+
+type Config struct {
+
+	// default listen/forward ip for routes without host
+	IP string `json:"ip,omitempty" yaml:"ip,omitempty"`
+
+	Log     string `json:"log,omitempty" yaml:"log,omitempty"`
+	Verbose bool   `json:"verbose,omitempty" yaml:"verbose,omitempty"`
+
+	// file of records of closed connections, stdout or stderr, disabled if empty,
+	// format is json by default or text/template of record fields
+	AccessLog       string `json:"access_log,omitempty" yaml:"access_log,omitempty"`
+	AccessLogFormat string `json:"access_log_format,omitempty" yaml:"access_log_format,omitempty"`
+
+	// defaults for routes without own timeouts
+	ClientIdleTimeout   Duration `json:"client_idle_timeout,omitempty" yaml:"client_idle_timeout,omitempty"`
+	UpstreamIdleTimeout Duration `json:"upstream_idle_timeout,omitempty" yaml:"upstream_idle_timeout,omitempty"`
+	HandshakeTimeout    Duration `json:"handshake_timeout,omitempty" yaml:"handshake_timeout,omitempty"`
+	DialTimeout         Duration `json:"dial_timeout,omitempty" yaml:"dial_timeout,omitempty"`
+	Retry               *Retry   `json:"retry,omitempty" yaml:"retry,omitempty"`
+
+	// default access lists of tcp routes without own ones
+	Allow      []string `json:"allow,omitempty" yaml:"allow,omitempty"`
+	Deny       []string `json:"deny,omitempty" yaml:"deny,omitempty"`
+	AccessFile string   `json:"access_file,omitempty" yaml:"access_file,omitempty"`
+
+	// idle timeout of udp sessions
+	SessionTimeout Duration `json:"session_timeout,omitempty" yaml:"session_timeout,omitempty"`
+
+	// listen address of prometheus /metrics endpoint, tcp or unix socket, disabled if empty
+	Metrics string `json:"metrics,omitempty" yaml:"metrics,omitempty"`
+
+	// listen address of admin api, tcp or unix socket, disabled if empty,
+	// requests need bearer token if it is set
+	Admin      string `json:"admin,omitempty" yaml:"admin,omitempty"`
+	AdminToken string `json:"admin_token,omitempty" yaml:"admin_token,omitempty"`
+
+	// time for active connections of routes removed by reload to finish
+	DrainTimeout Duration `json:"drain_timeout,omitempty" yaml:"drain_timeout,omitempty"`
+
+	Routes []Route `json:"routes" yaml:"routes"`
+}
+
+// LoadConfig reads JSON file if it has .json extension, otherwise YAML
+func LoadConfig(path string) (*Config, error) {
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Errorf("fail to read config '%s', %v", path, err)
+	}
+
+	conf := new(Config)
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(conf)
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		err = decoder.Decode(conf)
+	}
+
+	if err != nil {
+		return nil, errors.Errorf("fail to parse config '%s', %v", path, err)
+	}
+
+	return conf, nil
+}
+
+// Normalize expands port ranges, fills route defaults from the global settings and validates the config
+func (t *Config) Normalize() error {
+
+	if len(t.Routes) == 0 {
+		return errors.New("empty forward ports")
+	}
+
+	if t.ClientIdleTimeout < 0 || t.UpstreamIdleTimeout < 0 || t.HandshakeTimeout < 0 || t.DialTimeout < 0 {
+		return errors.New("negative socket timeout")
+	}
+	if t.HandshakeTimeout == 0 {
+		t.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	if t.DialTimeout == 0 {
+		t.DialTimeout = DefaultDialTimeout
+	}
+
+	if t.SessionTimeout < 0 {
+		return errors.New("negative session timeout")
+	} else if t.SessionTimeout == 0 {
+		t.SessionTimeout = DefaultSessionTimeout
+	}
+
+	if t.Metrics != "" {
+		if err := checkAddr(t.Metrics); err != nil {
+			return errors.Errorf("invalid metrics address, %v", err)
+		}
+	}
+
+	if _, err := parseAccessFormat(t.AccessLogFormat); err != nil {
+		return err
+	}
+
+	if t.Admin != "" {
+		if err := checkAddr(t.Admin); err != nil {
+			return errors.Errorf("invalid admin address, %v", err)
+		}
+		// admin api closes connections and disables routes, remote clients need the token
+		if t.AdminToken == "" && !isLocalAddr(t.Admin) {
+			return errors.Errorf("admin address '%s' is reachable from network, admin_token is required", t.Admin)
+		}
+	}
+
+	if t.DrainTimeout < 0 {
+		return errors.New("negative drain timeout")
+	} else if t.DrainTimeout == 0 {
+		t.DrainTimeout = DefaultDrainTimeout
+	}
+
+	listenAddrs := make(map[string]bool)
+	var routes []Route
+
+	for i, spec := range t.Routes {
+
+		expanded, err := spec.WithDefaultHost(t.IP).Expand()
+		if err != nil {
+			return errors.Errorf("route #%d '%s', %v", i+1, spec, err)
+		}
+
+		for _, route := range expanded {
+
+			if route.ClientIdleTimeout == 0 {
+				route.ClientIdleTimeout = t.ClientIdleTimeout
+			}
+			if route.UpstreamIdleTimeout == 0 {
+				route.UpstreamIdleTimeout = t.UpstreamIdleTimeout
+			}
+			if route.HandshakeTimeout == 0 {
+				route.HandshakeTimeout = t.HandshakeTimeout
+			}
+			if route.DialTimeout == 0 {
+				route.DialTimeout = t.DialTimeout
+			}
+			if route.Retry == nil {
+				route.Retry = t.Retry
+			}
+			if route.Protocol != ProtocolUDP && !route.restricted() {
+				route.Allow, route.Deny, route.AccessFile = t.Allow, t.Deny, t.AccessFile
+			}
+			if route.Protocol == ProtocolUDP && route.SessionTimeout == 0 {
+				route.SessionTimeout = t.SessionTimeout
+			}
+
+			if err := route.Validate(); err != nil {
+				return errors.Errorf("route #%d '%s', %v", i+1, route, err)
+			}
+
+			// tcp and udp could share the same port
+			listenKey := route.protocolPrefix() + route.ListenAddr
+			if listenAddrs[listenKey] {
+				return errors.Errorf("route #%d '%s', duplicate listen address", i+1, route)
+			}
+			listenAddrs[listenKey] = true
+
+			routes = append(routes, route)
+		}
+	}
+
+	t.Routes = routes
+	return nil
+}
+
+// isLocalAddr tells whether only clients of this host could connect to the address
+func isLocalAddr(addr string) bool {
+	if isUnixAddr(addr) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
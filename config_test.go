@@ -0,0 +1,96 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy_test
+
+import (
+	proxy "github.com/antihosting/tcp-proxy"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var yamlConfig = `
+ip: 127.0.0.1
+verbose: true
+client_idle_timeout: 30s
+upstream_idle_timeout: 30s
+routes:
+  - 80:8080
+  - listen: 0.0.0.0:443
+    forward: 10.0.0.5:8443
+    client_idle_timeout: 5m
+`
+
+var jsonConfig = `{
+  "ip": "127.0.0.1",
+  "verbose": true,
+  "client_idle_timeout": "30s",
+  "upstream_idle_timeout": 30,
+  "routes": [
+    "80:8080",
+    { "listen": "0.0.0.0:443", "forward": "10.0.0.5:8443", "client_idle_timeout": "5m" }
+  ]
+}`
+
+func TestLoadConfig(t *testing.T) {
+
+	dir := t.TempDir()
+
+	for name, content := range map[string]string{"proxy.yaml": yamlConfig, "proxy.json": jsonConfig} {
+
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+
+		conf, err := proxy.LoadConfig(path)
+		require.NoError(t, err, name)
+		require.NoError(t, conf.Normalize(), name)
+
+		require.True(t, conf.Verbose)
+		require.Equal(t, 2, len(conf.Routes))
+
+		require.Equal(t, "127.0.0.1:80", conf.Routes[0].ListenAddr)
+		require.Equal(t, "127.0.0.1:8080", conf.Routes[0].ForwardAddr)
+		require.Equal(t, proxy.Duration(30*time.Second), conf.Routes[0].ClientIdleTimeout)
+		require.Equal(t, proxy.Duration(30*time.Second), conf.Routes[0].UpstreamIdleTimeout)
+		require.Equal(t, proxy.DefaultHandshakeTimeout, conf.Routes[0].HandshakeTimeout)
+
+		require.Equal(t, "0.0.0.0:443", conf.Routes[1].ListenAddr)
+		require.Equal(t, "10.0.0.5:8443", conf.Routes[1].ForwardAddr)
+		require.Equal(t, proxy.Duration(5*time.Minute), conf.Routes[1].ClientIdleTimeout)
+		require.Equal(t, proxy.Duration(30*time.Second), conf.Routes[1].UpstreamIdleTimeout)
+	}
+
+	path := filepath.Join(dir, "unknown.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte("routes: [80:8080]\nunknown: 1\n"), 0600))
+	_, err := proxy.LoadConfig(path)
+	require.Error(t, err)
+
+}
+
+func TestAdminToken(t *testing.T) {
+
+	for admin, ok := range map[string]bool{
+		"127.0.0.1:9090":                  true,
+		"[::1]:9090":                      true,
+		"localhost:9090":                  true,
+		"unix:/run/port_proxy_admin.sock": true,
+		"0.0.0.0:9090":                    false,
+		":9090":                           false,
+		"10.0.0.5:9090":                   false,
+	} {
+		conf := &proxy.Config{Admin: admin, Routes: []proxy.Route{{ListenAddr: "127.0.0.1:80", ForwardAddr: "127.0.0.1:8080"}}}
+		if ok {
+			require.NoError(t, conf.Normalize(), admin)
+		} else {
+			require.Error(t, conf.Normalize(), admin)
+		}
+
+		// any address is fine with the token
+		conf.AdminToken = "secret"
+		require.NoError(t, conf.Normalize(), admin)
+	}
+}
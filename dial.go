@@ -0,0 +1,162 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/pkg/errors"
+	"net"
+	"time"
+)
+
+var (
+	DefaultDialTimeout = Duration(10 * time.Second)
+
+	DefaultRetryAttempts   = 3
+	DefaultRetryBackoff    = Duration(100 * time.Millisecond)
+	DefaultRetryMaxBackoff = Duration(2 * time.Second)
+)
+
+// Retry of failed upstream dial, every attempt goes to the next backend of the pool,
+// backoff doubles after each attempt up to max backoff, deadline limits total dial time
+type Retry struct {
+	Attempts   int      `json:"attempts,omitempty" yaml:"attempts,omitempty"`
+	Backoff    Duration `json:"backoff,omitempty" yaml:"backoff,omitempty"`
+	MaxBackoff Duration `json:"max_backoff,omitempty" yaml:"max_backoff,omitempty"`
+	Deadline   Duration `json:"deadline,omitempty" yaml:"deadline,omitempty"`
+}
+
+func (t *Retry) Validate() error {
+	if t.Attempts < 0 || t.Backoff < 0 || t.MaxBackoff < 0 || t.Deadline < 0 {
+		return errors.New("negative retry settings")
+	}
+	return nil
+}
+
+func (t Retry) withDefaults() Retry {
+	if t.Attempts == 0 {
+		t.Attempts = DefaultRetryAttempts
+	}
+	if t.Backoff == 0 {
+		t.Backoff = DefaultRetryBackoff
+	}
+	if t.MaxBackoff == 0 {
+		t.MaxBackoff = DefaultRetryMaxBackoff
+	}
+	return t
+}
+
+// dialUpstream dials backend for the client retrying with backoff on the next backends
+func (t *proxyServer) dialUpstream(ctx context.Context, upstream *upstream, info *connInfo) (net.Conn, *backend, error) {
+
+	client := info.client
+
+	retry := Retry{Attempts: 1}
+	if t.route.Retry != nil {
+		retry = t.route.Retry.withDefaults()
+	}
+
+	if retry.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(retry.Deadline))
+		defer cancel()
+	}
+
+	// pooled http connections outlive clients, so only dedicated ones tell the close reason
+	var onIdle func()
+	if t.route.Mode != ModeHTTP {
+		onIdle = func() {
+			info.closing(closedByProxy, reasonUpstreamIdle, nil)
+		}
+	}
+
+	dialer := net.Dialer{Timeout: t.dialTimeout}
+	backoff := time.Duration(retry.Backoff)
+	tried := make(map[*backend]bool)
+
+	for attempt := 1; ; attempt++ {
+
+		b := t.tryPick(upstream, client, tried)
+		if b == nil && len(tried) > 0 {
+			// every available backend was tried, start over
+			b = t.tryPick(upstream, client, nil)
+		}
+		if b == nil {
+			b = t.pickBackend(ctx, upstream, client)
+		}
+		if b == nil {
+			t.unavailable.Inc()
+			return nil, nil, errors.Errorf("no available backends for '%s'", t.listenAddr)
+		}
+
+		network, addr := dialNetwork(b.addr)
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			b.dialLatency.observe(time.Since(start))
+			conn = newIdleConn(conn, t.upstreamIdleTimeout, onIdle)
+		}
+		if err == nil && t.route.SendProxy != "" {
+			if err = writeProxyHeader(conn, t.route.SendProxy, info); err != nil {
+				conn.Close()
+			}
+		}
+		if err == nil && t.upstreamTLS != nil {
+			conn, err = t.handshakeUpstream(conn, b)
+		}
+		// breaker counts success after backend answers the client
+		if err == nil {
+			info.backend.Store(b.addr)
+			return conn, b, nil
+		}
+
+		t.dialFailed(b, err)
+		tried[b] = true
+
+		if attempt >= retry.Attempts || ctx.Err() != nil {
+			t.unavailable.Inc()
+			return nil, b, err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <- timer.C:
+		case <- ctx.Done():
+			timer.Stop()
+			t.unavailable.Inc()
+			return nil, b, err
+		}
+
+		backoff *= 2
+		if backoff > time.Duration(retry.MaxBackoff) {
+			backoff = time.Duration(retry.MaxBackoff)
+		}
+	}
+}
+
+// handshakeUpstream starts tls on the dialed backend connection within handshake timeout
+func (t *proxyServer) handshakeUpstream(conn net.Conn, b *backend) (net.Conn, error) {
+
+	config := t.upstreamTLS
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = "localhost"
+		if host, _, err := net.SplitHostPort(b.addr); err == nil && !isUnixAddr(b.addr) {
+			config.ServerName = host
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(t.handshakeTimeout))
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, errors.Errorf("tls handshake error, %v", err)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
@@ -0,0 +1,61 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"time"
+)
+
+// Duration is time.Duration written in config files as "30s", "1m" and etc, plain numbers are seconds
+type Duration time.Duration
+
+func (t Duration) String() string {
+	return time.Duration(t).String()
+}
+
+func (t Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+func (t *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	return t.set(value)
+}
+
+func (t Duration) MarshalYAML() (interface{}, error) {
+	return t.String(), nil
+}
+
+func (t *Duration) UnmarshalYAML(node *yaml.Node) error {
+	var value interface{}
+	if err := node.Decode(&value); err != nil {
+		return err
+	}
+	return t.set(value)
+}
+
+func (t *Duration) set(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return errors.Errorf("invalid duration '%s', %v", v, err)
+		}
+		*t = Duration(d)
+	case int:
+		*t = Duration(time.Duration(v) * time.Second)
+	case float64:
+		*t = Duration(v * float64(time.Second))
+	default:
+		return errors.Errorf("invalid duration '%v'", value)
+	}
+	return nil
+}
@@ -59,7 +59,8 @@ func (t *echoServer) String() string {
 
 func (t *echoServer) Bind() (err error) {
 
-	t.listener, err = t.lc.Listen(t.ctx, "tcp4", t.listenAddr)
+	network, addr := listenNetwork(t.listenAddr, false)
+	t.listener, err = t.lc.Listen(t.ctx, network, addr)
 	if err != nil {
 		return errors.Errorf("Listen address is busy '%s', %v", t.listenAddr, err)
 	}
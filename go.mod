@@ -5,7 +5,9 @@ go 1.16
 require (
 	github.com/pkg/errors v0.9.1
 	github.com/schwid/base62 v1.1.0
+	github.com/stretchr/testify v1.8.4
 	go.uber.org/atomic v1.10.0
 	golang.org/x/crypto v0.2.0
 	golang.org/x/sync v0.0.0-20220722155255-886fb9371eb4
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,263 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	HealthCheckTCP        = "tcp"
+	HealthCheckSendExpect = "send-expect"
+	HealthCheckHTTP       = "http"
+)
+
+var (
+	DefaultHealthCheckInterval = Duration(10 * time.Second)
+	DefaultHealthCheckTimeout  = Duration(2 * time.Second)
+	DefaultHealthCheckRise     = 2
+	DefaultHealthCheckFall     = 3
+)
+
+type HealthCheck struct {
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+
+	Interval Duration `json:"interval,omitempty" yaml:"interval,omitempty"`
+	Timeout  Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+
+	// consecutive successes to bring backend up and failures to take it down
+	Rise int `json:"rise,omitempty" yaml:"rise,omitempty"`
+	Fall int `json:"fall,omitempty" yaml:"fall,omitempty"`
+
+	// send-expect check, the response must contain expect bytes
+	Send   string `json:"send,omitempty" yaml:"send,omitempty"`
+	Expect string `json:"expect,omitempty" yaml:"expect,omitempty"`
+
+	// http check, any 2xx or 3xx status matches when status list is empty
+	Path   string `json:"path,omitempty" yaml:"path,omitempty"`
+	Host   string `json:"host,omitempty" yaml:"host,omitempty"`
+	Status []int  `json:"status,omitempty" yaml:"status,omitempty"`
+}
+
+func (t *HealthCheck) Validate() error {
+
+	switch t.Type {
+	case "", HealthCheckTCP:
+	case HealthCheckSendExpect:
+		if t.Expect == "" {
+			return errors.New("empty expect of send-expect health check")
+		}
+	case HealthCheckHTTP:
+	default:
+		return errors.Errorf("unknown health check type '%s', expected one of %s, %s, %s", t.Type, HealthCheckTCP, HealthCheckSendExpect, HealthCheckHTTP)
+	}
+
+	if t.Interval < 0 || t.Timeout < 0 || t.Rise < 0 || t.Fall < 0 {
+		return errors.New("negative health check settings")
+	}
+
+	return nil
+}
+
+// withDefaults returns copy of health check with empty settings filled by defaults
+func (t HealthCheck) withDefaults() HealthCheck {
+	if t.Type == "" {
+		t.Type = HealthCheckTCP
+	}
+	if t.Interval == 0 {
+		t.Interval = DefaultHealthCheckInterval
+	}
+	if t.Timeout == 0 {
+		t.Timeout = DefaultHealthCheckTimeout
+	}
+	if t.Rise == 0 {
+		t.Rise = DefaultHealthCheckRise
+	}
+	if t.Fall == 0 {
+		t.Fall = DefaultHealthCheckFall
+	}
+	if t.Path == "" {
+		t.Path = "/"
+	}
+	return t
+}
+
+type healthChecker struct {
+	check   HealthCheck
+	backend *backend
+	server  *proxyServer
+}
+
+// run checks backend every interval until context is done
+func (t *healthChecker) run(ctx context.Context) {
+
+	interval := time.Duration(t.check.Interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var successes, failures int
+
+	for {
+
+		err := t.probe(ctx)
+
+		if err == nil {
+			successes++
+			failures = 0
+			if !t.backend.healthy.Load() && successes >= t.check.Rise {
+				t.server.setHealthy(t.backend, true, nil)
+			}
+		} else {
+			failures++
+			successes = 0
+			if t.backend.healthy.Load() && failures >= t.check.Fall {
+				t.server.setHealthy(t.backend, false, err)
+			}
+		}
+
+		select {
+		case <- ctx.Done():
+			return
+		case <- ticker.C:
+		}
+	}
+}
+
+func (t *healthChecker) probe(ctx context.Context) error {
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(t.check.Timeout))
+	defer cancel()
+
+	if t.check.Type == HealthCheckHTTP {
+		return t.probeHTTP(ctx)
+	}
+
+	conn, err := t.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if t.check.Type != HealthCheckSendExpect {
+		return nil
+	}
+
+	if t.check.Send != "" {
+		if _, err := conn.Write([]byte(t.check.Send)); err != nil {
+			return err
+		}
+	}
+
+	expect := []byte(t.check.Expect)
+	var response []byte
+	buf := make([]byte, 4096)
+
+	for len(response) < 64 * 1024 {
+		n, err := conn.Read(buf)
+		response = append(response, buf[:n]...)
+		if bytes.Contains(response, expect) {
+			return nil
+		}
+		if err != nil {
+			return errors.Errorf("expected '%s' not received, %v", t.check.Expect, err)
+		}
+	}
+
+	return errors.Errorf("expected '%s' not received", t.check.Expect)
+}
+
+// dial connects to backend the same way as proxied connections, with PROXY protocol header and upstream tls
+func (t *healthChecker) dial(ctx context.Context) (net.Conn, error) {
+
+	var d net.Dialer
+	network, addr := dialNetwork(t.backend.addr)
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.server.route.SendProxy != "" {
+		// health check tells its own addresses to the backend
+		info := &connInfo{client: conn.LocalAddr(), local: conn.RemoteAddr()}
+		if err := writeProxyHeader(conn, t.server.route.SendProxy, info); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if t.server.upstreamTLS != nil {
+		if conn, err = t.server.handshakeUpstream(conn, t.backend); err != nil {
+			return nil, err
+		}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+func (t *healthChecker) probeHTTP(ctx context.Context) error {
+
+	// health checks connect to backend directly, without keep-alive and environment proxy,
+	// request is plain http on the connection that is already tls if upstream is
+	transport := &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return t.dial(ctx)
+		},
+	}
+
+	host := t.backend.addr
+	if isUnixAddr(t.backend.addr) {
+		host = "localhost"
+	}
+
+	url := fmt.Sprintf("http://%s%s", host, t.check.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if t.check.Host != "" {
+		req.Host = t.check.Host
+	}
+
+	client := http.Client{
+		Transport: transport,
+		// health check verifies the backend itself
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64 * 1024))
+	resp.Body.Close()
+
+	if len(t.check.Status) == 0 {
+		if resp.StatusCode >= 200 && resp.StatusCode < 400 {
+			return nil
+		}
+	} else {
+		for _, status := range t.check.Status {
+			if resp.StatusCode == status {
+				return nil
+			}
+		}
+	}
+
+	return errors.Errorf("unexpected status %d", resp.StatusCode)
+}
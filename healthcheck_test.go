@@ -0,0 +1,125 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"github.com/stretchr/testify/require"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	route := Route{
+		ListenAddr:  "127.0.0.1:0",
+		ForwardAddr: listener.Addr().String(),
+		HealthCheck: &HealthCheck{
+			Type:     HealthCheckHTTP,
+			Path:     "/health",
+			Interval: Duration(10 * time.Millisecond),
+			Rise:     1,
+			Fall:     1,
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewProxyServer(ctx, route, log.Default(), false)
+	b := server.upstream.backends[0]
+
+	go (&healthChecker{check: *b.check, backend: b, server: server}).run(ctx)
+
+	time.Sleep(50 * time.Millisecond)
+	require.True(t, b.healthy.Load())
+
+	changed := server.upstream.stateChanged()
+	listener.Close()
+
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("backend state was not changed")
+	}
+	require.False(t, b.healthy.Load())
+	require.Nil(t, server.pickBackend(ctx, server.upstream, nil))
+
+}
+
+func TestHealthCheckUpstream(t *testing.T) {
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "backend")
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// backend requires PROXY protocol header and tls after it
+	headers := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				line, err := reader.ReadString('\n')
+				if err != nil || !strings.HasPrefix(line, "PROXY TCP4 ") {
+					return
+				}
+				headers <- line
+				tlsConn := tls.Server(&peekedConn{Conn: conn, reader: reader}, &tls.Config{Certificates: []tls.Certificate{cert}})
+				req, err := http.ReadRequest(bufio.NewReader(tlsConn))
+				if err == nil {
+					(&http.Response{StatusCode: http.StatusOK, ProtoMajor: 1, ProtoMinor: 1, Request: req}).Write(tlsConn)
+				}
+			}()
+		}
+	}()
+
+	route := Route{
+		ListenAddr:  "127.0.0.1:0",
+		ForwardAddr: listener.Addr().String(),
+		SendProxy:   ProxyProtocolV1,
+		UpstreamTLS: &UpstreamTLS{CA: certFile},
+		HealthCheck: &HealthCheck{Type: HealthCheckHTTP, Timeout: Duration(time.Second)},
+	}
+
+	server := NewProxyServer(context.Background(), route, log.Default(), false)
+	require.NoError(t, server.prepare())
+	b := server.upstream.backends[0]
+	checker := &healthChecker{check: *b.check, backend: b, server: server}
+
+	require.NoError(t, checker.probe(context.Background()))
+	require.Equal(t, 1, len(headers))
+
+	checker.check.Type = HealthCheckTCP
+	require.NoError(t, checker.probe(context.Background()))
+	require.Equal(t, 2, len(headers))
+}
@@ -0,0 +1,449 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// idle upstream connections kept for reuse by every backend of http route
+	DefaultHTTPMaxIdle     = 32
+	DefaultHTTPIdleTimeout = 90 * time.Second
+)
+
+// HTTPRoute forwards requests with the host and path prefix to own backends
+type HTTPRoute struct {
+
+	// exact name, wildcard of one label like *.example.com or empty for any host
+	Host string `json:"host,omitempty" yaml:"host,omitempty"`
+
+	// path prefix matching whole segments, /api matches /api and /api/users but not /apis
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
+
+	ForwardAddr string    `json:"forward,omitempty" yaml:"forward,omitempty"`
+	Backends    []Backend `json:"backends,omitempty" yaml:"backends,omitempty"`
+}
+
+func (t HTTPRoute) String() string {
+	host := t.Host
+	if host == "" {
+		host = "*"
+	}
+	return host + t.Path + "=" + targetsString(t.ForwardAddr, t.Backends)
+}
+
+func (t HTTPRoute) Validate() error {
+	if t.Host != "" {
+		if err := checkHostPattern(strings.ToLower(t.Host)); err != nil {
+			return errors.Errorf("invalid http route, %v", err)
+		}
+	}
+	if t.Path != "" && !strings.HasPrefix(t.Path, "/") {
+		return errors.Errorf("invalid http route path '%s', expected to start with /", t.Path)
+	}
+	if err := validateTargets(t.ForwardAddr, t.Backends); err != nil {
+		return errors.Errorf("http route '%s', %v", t, err)
+	}
+	return nil
+}
+
+type httpUpstream struct {
+	host     string
+	path     string
+	upstream *upstream
+}
+
+// matchHTTP returns upstream of the most specific host, exact name wins over wildcard and wildcard over any host,
+// among them the longest path prefix wins, nil if none matches
+func matchHTTP(list []httpUpstream, host, path string) *upstream {
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var wildcard string
+	if i := strings.IndexByte(host, '.'); i > 0 {
+		wildcard = "*" + host[i:]
+	}
+
+	var best *httpUpstream
+	bestScore := -1
+
+	for i := range list {
+		h := &list[i]
+
+		var score int
+		switch h.host {
+		case "":
+			score = 0
+		case host:
+			score = 2
+		case wildcard:
+			score = 1
+		default:
+			continue
+		}
+
+		if !matchPath(h.path, path) {
+			continue
+		}
+
+		if score > bestScore || (score == bestScore && len(h.path) > len(best.path)) {
+			best, bestScore = h, score
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+	return best.upstream
+}
+
+func matchPath(prefix, path string) bool {
+	if prefix == "" || prefix == path {
+		return true
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// httpConn is upstream connection of http route
+type httpConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	backend *backend
+
+	idleSince time.Time
+}
+
+// countingConn counts bytes sent to and received from the backend
+type countingConn struct {
+	net.Conn
+	backend *backend
+}
+
+func (t countingConn) Read(p []byte) (int, error) {
+	n, err := t.Conn.Read(p)
+	t.backend.bytesOut.Add(int64(n))
+	return n, err
+}
+
+func (t countingConn) Write(p []byte) (int, error) {
+	n, err := t.Conn.Write(p)
+	t.backend.bytesIn.Add(int64(n))
+	return n, err
+}
+
+// httpPool keeps idle upstream connections by backend
+type httpPool struct {
+	mu     sync.Mutex
+	idle   map[*backend][]*httpConn
+	closed bool
+}
+
+func newHTTPPool() *httpPool {
+	return &httpPool{idle: make(map[*backend][]*httpConn)}
+}
+
+// get returns the most recent idle connection of the backend, expired ones are closed
+func (t *httpPool) get(b *backend) *httpConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list := t.idle[b]
+	for len(list) > 0 {
+		conn := list[len(list)-1]
+		list = list[:len(list)-1]
+		if time.Since(conn.idleSince) < DefaultHTTPIdleTimeout {
+			t.idle[b] = list
+			return conn
+		}
+		conn.Close()
+	}
+	delete(t.idle, b)
+	return nil
+}
+
+// put returns connection to the pool, false if pool is full or closed
+func (t *httpPool) put(conn *httpConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed || len(t.idle[conn.backend]) >= DefaultHTTPMaxIdle {
+		return false
+	}
+	conn.idleSince = time.Now()
+	t.idle[conn.backend] = append(t.idle[conn.backend], conn)
+	return true
+}
+
+func (t *httpPool) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	for b, list := range t.idle {
+		for _, conn := range list {
+			conn.Close()
+		}
+		delete(t.idle, b)
+	}
+}
+
+// serveHTTP forwards keep-alive requests of the client, upgrade requests switch the connection to raw forwarding
+func (t *proxyServer) serveHTTP(ctx context.Context, conn net.Conn, info *connInfo) error {
+
+	reader := bufio.NewReader(conn)
+
+	for {
+
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			writeHTTPError(conn, http.StatusBadRequest)
+			return err
+		}
+
+		upstream := t.matchRequest(req)
+		if upstream == nil {
+			t.log.Printf("ProxyServe '%s' rejected request '%s%s' of client '%s', no http route\n", t.listenAddr, req.Host, req.URL.Path, addrString(conn.RemoteAddr()))
+			writeHTTPError(conn, http.StatusNotFound)
+			return errors.Errorf("no http route for '%s%s'", req.Host, req.URL.Path)
+		}
+
+		setForwardedHeaders(req, conn)
+
+		upgrade := isUpgrade(req)
+		removeHopHeaders(req.Header, upgrade)
+
+		if upgrade {
+			target, backend, err := t.dialUpstream(ctx, upstream, info)
+			if err != nil {
+				writeHTTPError(conn, http.StatusBadGateway)
+				return err
+			}
+			if err := req.Write(target); err != nil {
+				t.breakerFailure(backend)
+				target.Close()
+				writeHTTPError(conn, http.StatusBadGateway)
+				return err
+			}
+			// client could send data right after the request, it is in the reader
+			return t.relay(ctx, &peekedConn{Conn: conn, reader: reader}, target, backend, info)
+		}
+
+		// request is written after the body is read, so the proxy lets client send it
+		if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+			req.Header.Del("Expect")
+			if req.Body != http.NoBody && req.ProtoAtLeast(1, 1) {
+				if _, err := io.WriteString(conn, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+					return err
+				}
+			}
+		}
+
+		resp, uc, err := t.roundTrip(ctx, upstream, req, info)
+		if err != nil {
+			t.log.Printf("ProxyServe '%s' request '%s%s' of client '%s' error, %v\n", t.listenAddr, req.Host, req.URL.Path, addrString(conn.RemoteAddr()), err)
+			writeHTTPError(conn, http.StatusBadGateway)
+			return err
+		}
+
+		if t.verbose.Load() {
+			t.log.Printf("Request from '%s' %s '%s%s' to backend '%s' status %d\n", addrString(conn.RemoteAddr()), req.Method, req.Host, req.URL.Path, uc.backend.addr, resp.StatusCode)
+		}
+
+		removeHopHeaders(resp.Header, false)
+		err = resp.Write(conn)
+		resp.Body.Close()
+		t.releaseHTTPConn(uc, err != nil || resp.Close)
+
+		if err != nil {
+			return err
+		}
+		if req.Close || resp.Close {
+			return nil
+		}
+	}
+}
+
+// matchRequest returns upstream of http route or default one, nil if none matches
+func (t *proxyServer) matchRequest(req *http.Request) *upstream {
+
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if upstream := matchHTTP(t.httpRoutes, host, req.URL.Path); upstream != nil {
+		return upstream
+	}
+	if len(t.upstream.backends) > 0 {
+		return t.upstream
+	}
+	return nil
+}
+
+// roundTrip sends request to the idle or new upstream connection, idempotent request without body
+// is repeated on the new connection when idle one was closed by backend
+func (t *proxyServer) roundTrip(ctx context.Context, upstream *upstream, req *http.Request, info *connInfo) (*http.Response, *httpConn, error) {
+
+	for {
+
+		uc, reused, err := t.httpConn(ctx, upstream, info)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = req.Write(uc)
+
+		var resp *http.Response
+		if err == nil {
+			resp, err = http.ReadResponse(uc.reader, req)
+			// informational responses are optional for clients
+			for err == nil && resp.StatusCode/100 == 1 && resp.StatusCode != http.StatusSwitchingProtocols {
+				resp, err = http.ReadResponse(uc.reader, req)
+			}
+		}
+
+		if err == nil {
+			t.breakerSuccess(uc.backend)
+			return resp, uc, nil
+		}
+
+		// new connection of the backend failed without response
+		if !reused {
+			uc.backend.earlyResets.Inc()
+			t.breakerFailure(uc.backend)
+		}
+		t.releaseHTTPConn(uc, true)
+
+		if !reused || req.Body != http.NoBody || !isIdempotent(req) {
+			return nil, nil, err
+		}
+	}
+}
+
+// httpConn returns idle connection of the picked backend or dials the new one
+func (t *proxyServer) httpConn(ctx context.Context, upstream *upstream, info *connInfo) (*httpConn, bool, error) {
+
+	if b := upstream.pick(info.client, (*backend).available); b != nil {
+		if uc := t.httpPool.get(b); uc != nil {
+			b.total.Inc()
+			b.active.Inc()
+			return uc, true, nil
+		}
+	}
+
+	conn, b, err := t.dialUpstream(ctx, upstream, info)
+	if err != nil {
+		if b == nil {
+			t.log.Printf("ProxyServe '%s' rejected client '%s', no available backends\n", t.listenAddr, addrString(info.client))
+		}
+		return nil, false, err
+	}
+
+	b.total.Inc()
+	b.active.Inc()
+
+	counting := countingConn{Conn: conn, backend: b}
+	return &httpConn{Conn: counting, reader: bufio.NewReader(counting), backend: b}, false, nil
+}
+
+// releaseHTTPConn returns connection to the pool if it could be reused,
+// connection with PROXY protocol header belongs to one client and is never reused
+func (t *proxyServer) releaseHTTPConn(uc *httpConn, close bool) {
+	uc.backend.active.Dec()
+	if close || uc.reader.Buffered() > 0 || t.route.SendProxy != "" || !t.httpPool.put(uc) {
+		uc.Close()
+	}
+}
+
+func isUpgrade(req *http.Request) bool {
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isIdempotent tells whether request could be repeated after backend closed idle connection,
+// PUT and DELETE are repeated only with the key of idempotency
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	case http.MethodPut, http.MethodDelete:
+		return req.Header.Get("Idempotency-Key") != ""
+	default:
+		return false
+	}
+}
+
+// removeHopHeaders drops headers of one connection (RFC 7230 section 6.1), upgrade request keeps Connection and Upgrade
+func removeHopHeaders(header http.Header, upgrade bool) {
+	for _, value := range header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.TrimSpace(token); token != "" && !(upgrade && strings.EqualFold(token, "upgrade")) {
+				header.Del(token)
+			}
+		}
+	}
+	for _, name := range []string{"Keep-Alive", "Te", "Trailer", "Transfer-Encoding"} {
+		header.Del(name)
+	}
+	for name := range header {
+		if strings.HasPrefix(name, "Proxy-") {
+			delete(header, name)
+		}
+	}
+	if upgrade {
+		header.Set("Connection", "Upgrade")
+	} else {
+		header.Del("Connection")
+		header.Del("Upgrade")
+	}
+}
+
+func setForwardedHeaders(req *http.Request, conn net.Conn) {
+
+	if ip := clientIP(conn.RemoteAddr()); ip != "" {
+		if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+
+	proto := "http"
+	if _, ok := conn.(*tls.Conn); ok {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+
+	// request writer adds own user agent otherwise
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header["User-Agent"] = []string{""}
+	}
+}
+
+func writeHTTPError(conn net.Conn, status int) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+}
@@ -0,0 +1,272 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchHTTP(t *testing.T) {
+
+	fallback, api, users, wildcard := &upstream{}, &upstream{}, &upstream{}, &upstream{}
+	list := []httpUpstream{
+		{path: "/", upstream: fallback},
+		{host: "api.example.com", upstream: api},
+		{host: "api.example.com", path: "/users", upstream: users},
+		{host: "*.example.com", path: "/", upstream: wildcard},
+	}
+
+	require.Same(t, api, matchHTTP(list, "api.example.com", "/orders"))
+	require.Same(t, users, matchHTTP(list, "API.example.com", "/users/1"))
+	require.Same(t, api, matchHTTP(list, "api.example.com", "/usersx"))
+	require.Same(t, wildcard, matchHTTP(list, "www.example.com", "/"))
+	require.Same(t, fallback, matchHTTP(list, "example.net", "/index.html"))
+	require.Nil(t, matchHTTP(list[1:], "example.net", "/"))
+}
+
+func TestHTTPMode(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// backends answer with own name and count connections
+	backend := func(name string) (string, *atomic.Int64) {
+		conns := atomic.NewInt64(0)
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write([]byte(name + " " + r.URL.Path + " " + string(body)))
+		}))
+		server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				conns.Inc()
+			}
+		}
+		server.Start()
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+		return server.Listener.Addr().String(), conns
+	}
+
+	apiAddr, apiConns := backend("api")
+	webAddr, _ := backend("web")
+
+	// upgraded connection echoes raw bytes
+	upgrade, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer upgrade.Close()
+	go func() {
+		for {
+			conn, err := upgrade.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				if _, err := http.ReadRequest(reader); err != nil {
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+				io.Copy(conn, reader)
+			}()
+		}
+	}()
+
+	route := Route{
+		ListenAddr:  "127.0.0.1:51250",
+		ForwardAddr: webAddr,
+		Mode:        ModeHTTP,
+		HTTPRoutes: []HTTPRoute{
+			{Host: "api.example.com", ForwardAddr: apiAddr},
+			{Path: "/ws", ForwardAddr: upgrade.Addr().String()},
+		},
+	}
+	require.NoError(t, route.Validate())
+
+	server := NewProxyServer(ctx, route, log.Default(), false)
+	require.NoError(t, server.Bind())
+	defer server.Close()
+	go server.Serve()
+
+	client := &http.Client{}
+
+	request := func(host, path, body string) string {
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:51250"+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Host = host
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		answer, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(answer)
+	}
+
+	for i := 0; i < 5; i++ {
+		require.Equal(t, "api /orders ping", request("api.example.com", "/orders", "ping"))
+		require.Equal(t, "web /index.html ", request("www.example.com", "/index.html", ""))
+	}
+
+	// upstream connection is reused by keep-alive requests
+	require.Equal(t, int64(1), apiConns.Load())
+
+	conn, err := net.Dial("tcp", "127.0.0.1:51250")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: www.example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nping"))
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	answer := make([]byte, 4)
+	_, err = io.ReadFull(reader, answer)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(answer))
+}
+
+func TestHTTPHeaders(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// backend answers with hop-by-hop headers it received and sends own ones
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var received []string
+		for _, name := range []string{"X-Secret", "Keep-Alive", "Proxy-Authorization", "Te", "Expect", "X-Forwarded-For"} {
+			if r.Header.Get(name) != "" {
+				received = append(received, name)
+			}
+		}
+		w.Header().Set("Connection", "X-Internal")
+		w.Header().Set("X-Internal", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Write([]byte(strings.Join(received, ",") + " " + string(body)))
+	}))
+	defer backend.Close()
+
+	route := Route{
+		ListenAddr:  "127.0.0.1:51251",
+		ForwardAddr: backend.Listener.Addr().String(),
+		Mode:        ModeHTTP,
+	}
+	server := NewProxyServer(ctx, route, log.Default(), false)
+	require.NoError(t, server.Bind())
+	defer server.Close()
+	go server.Serve()
+
+	conn, err := net.Dial("tcp", route.ListenAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("POST /upload HTTP/1.1\r\nHost: www.example.com\r\nConnection: X-Secret\r\nX-Secret: 1\r\n" +
+		"Keep-Alive: 300\r\nProxy-Authorization: Basic Zm9vOmJhcg==\r\nTe: trailers\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n"))
+	require.NoError(t, err)
+
+	// client waits for the proxy to continue before sending the body
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusContinue, resp.StatusCode)
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	resp, err = http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("X-Internal"))
+	require.Empty(t, resp.Header.Get("Keep-Alive"))
+	require.Empty(t, resp.Header.Get("Connection"))
+
+	answer, err := ioutil.ReadAll(io.LimitReader(resp.Body, resp.ContentLength))
+	require.NoError(t, err)
+	require.Equal(t, "X-Forwarded-For ping", string(answer))
+}
+
+func TestHTTPRetry(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// backend answers one request per connection and closes it without telling the client
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	requests := atomic.NewInt64(0)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				requests.Inc()
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+			}()
+		}
+	}()
+
+	route := Route{
+		ListenAddr:  "127.0.0.1:51252",
+		ForwardAddr: listener.Addr().String(),
+		Mode:        ModeHTTP,
+	}
+	server := NewProxyServer(ctx, route, log.New(ioutil.Discard, "", 0), false)
+	require.NoError(t, server.Bind())
+	defer server.Close()
+	go server.Serve()
+
+	conn, err := net.Dial("tcp", route.ListenAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	status := func(request string) int {
+		_, err := conn.Write([]byte(request))
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, status("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+	require.Eventually(t, func() bool { return requests.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	// stale idle connection is replaced for GET
+	require.Equal(t, http.StatusOK, status("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+	time.Sleep(50 * time.Millisecond)
+
+	// request that is not idempotent could have been processed, it is not repeated
+	require.Equal(t, http.StatusBadGateway, status("POST / HTTP/1.1\r\nHost: www.example.com\r\nContent-Length: 0\r\n\r\n"))
+	require.Equal(t, int64(2), requests.Load())
+}
@@ -0,0 +1,91 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"go.uber.org/atomic"
+	"net"
+	"sync"
+	"time"
+)
+
+var DefaultHandshakeTimeout = Duration(10 * time.Second)
+
+// idleConn is closed when it has no reads and writes longer than timeout,
+// so busy connection in any direction stays open
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+
+	// called before the connection is closed by timeout, could be nil
+	onIdle func()
+
+	// unix nanoseconds of the last read or write
+	lastActive atomic.Int64
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+// newIdleConn wraps connection by idle timeout, zero timeout leaves it as is
+func newIdleConn(conn net.Conn, timeout time.Duration, onIdle func()) net.Conn {
+	if timeout <= 0 {
+		return conn
+	}
+	t := &idleConn{Conn: conn, timeout: timeout, onIdle: onIdle}
+	t.lastActive.Store(time.Now().UnixNano())
+	// timer could fire before it is stored
+	t.mu.Lock()
+	t.timer = time.AfterFunc(timeout, t.check)
+	t.mu.Unlock()
+	return t
+}
+
+// check closes connection after timeout since the last activity, otherwise waits for the rest of it
+func (t *idleConn) check() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.timer == nil {
+		return
+	}
+
+	idle := time.Since(time.Unix(0, t.lastActive.Load()))
+	if idle < t.timeout {
+		t.timer.Reset(t.timeout - idle)
+		return
+	}
+
+	if t.onIdle != nil {
+		t.onIdle()
+	}
+	t.Conn.Close()
+}
+
+func (t *idleConn) Read(p []byte) (int, error) {
+	n, err := t.Conn.Read(p)
+	if n > 0 {
+		t.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (t *idleConn) Write(p []byte) (int, error) {
+	n, err := t.Conn.Write(p)
+	if n > 0 {
+		t.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (t *idleConn) Close() error {
+	t.mu.Lock()
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	t.mu.Unlock()
+	return t.Conn.Close()
+}
@@ -0,0 +1,92 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeout(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// backend streams one byte every 100ms on request, otherwise stays silent
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				request := make([]byte, 1)
+				if _, err := conn.Read(request); err != nil || request[0] != 's' {
+					return
+				}
+				for i := 0; i < 10; i++ {
+					time.Sleep(100 * time.Millisecond)
+					if _, err := conn.Write([]byte{'x'}); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	route := Route{
+		ListenAddr:          "127.0.0.1:51550",
+		ForwardAddr:         listener.Addr().String(),
+		ClientIdleTimeout:   Duration(300 * time.Millisecond),
+		UpstreamIdleTimeout: Duration(300 * time.Millisecond),
+	}
+	require.NoError(t, route.Validate())
+
+	server := NewProxyServer(ctx, route, log.Default(), false)
+	require.NoError(t, server.Bind())
+	defer server.Close()
+	go server.Serve()
+
+	// one-way traffic keeps connection open longer than idle timeout
+	conn, err := net.Dial("tcp", "127.0.0.1:51550")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte{'s'})
+	require.NoError(t, err)
+
+	received := make([]byte, 10)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for n := 0; n < len(received); {
+		k, err := conn.Read(received[n:])
+		require.NoError(t, err)
+		n += k
+	}
+	require.Equal(t, "xxxxxxxxxx", string(received))
+
+	// silent connection is closed after idle timeout
+	idle, err := net.Dial("tcp", "127.0.0.1:51550")
+	require.NoError(t, err)
+	defer idle.Close()
+
+	start := time.Now()
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = idle.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), "timeout")
+	require.Less(t, int64(time.Since(start)), int64(2*time.Second))
+
+	// closed by idle timeout, not counted as backend reset
+	require.Equal(t, int64(0), server.upstream.backends[0].earlyResets.Load())
+}
@@ -0,0 +1,142 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+	"time"
+)
+
+const (
+	LimitActionReject = "reject"
+	LimitActionQueue  = "queue"
+)
+
+var DefaultQueueTimeout = Duration(5 * time.Second)
+
+// ConnLimit caps concurrent client connections of the route, clients over the limit
+// are rejected or wait in the bounded queue until some connection finishes
+type ConnLimit struct {
+	Max    int    `json:"max" yaml:"max"`
+	Action string `json:"action,omitempty" yaml:"action,omitempty"`
+
+	// clients waiting for a free slot, the same as max if empty
+	Queue        int      `json:"queue,omitempty" yaml:"queue,omitempty"`
+	QueueTimeout Duration `json:"queue_timeout,omitempty" yaml:"queue_timeout,omitempty"`
+}
+
+func (t *ConnLimit) Validate() error {
+	if t.Max <= 0 {
+		return errors.New("max connections must be positive")
+	}
+	switch t.Action {
+	case "", LimitActionReject, LimitActionQueue:
+	default:
+		return errors.Errorf("unknown limit action '%s', expected %s or %s", t.Action, LimitActionReject, LimitActionQueue)
+	}
+	if t.Queue < 0 || t.QueueTimeout < 0 {
+		return errors.New("negative connection queue settings")
+	}
+	return nil
+}
+
+// connLimiter holds slots of active connections and counts clients over the limit
+type connLimiter struct {
+	max          int
+	queue        int
+	queueTimeout time.Duration
+
+	slots chan struct{}
+
+	active   atomic.Int64
+	peak     atomic.Int64
+	queued   atomic.Int64
+	rejected atomic.Int64
+
+	// set when all slots are taken, reset by the next client taking slot without waiting
+	full atomic.Bool
+}
+
+func newConnLimiter(conf ConnLimit) *connLimiter {
+	t := &connLimiter{
+		max:          conf.Max,
+		queueTimeout: time.Duration(conf.QueueTimeout),
+		slots:        make(chan struct{}, conf.Max),
+	}
+	if conf.Action == LimitActionQueue {
+		t.queue = conf.Queue
+		if t.queue == 0 {
+			t.queue = conf.Max
+		}
+	}
+	if t.queueTimeout == 0 {
+		t.queueTimeout = time.Duration(DefaultQueueTimeout)
+	}
+	return t
+}
+
+func (t *connLimiter) String() string {
+	return fmt.Sprintf("ConnLimit {max=%d active=%d peak=%d queued=%d rejected=%d}",
+		t.max, t.active.Load(), t.peak.Load(), t.queued.Load(), t.rejected.Load())
+}
+
+// tryAcquire takes slot without waiting
+func (t *connLimiter) tryAcquire() bool {
+	select {
+	case t.slots <- struct{}{}:
+		t.acquired()
+		t.full.Store(false)
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *connLimiter) acquired() {
+	active := t.active.Inc()
+	for {
+		peak := t.peak.Load()
+		if active <= peak || t.peak.CAS(peak, active) {
+			return
+		}
+	}
+}
+
+// enqueue reserves place in the queue, false if client is rejected
+func (t *connLimiter) enqueue() bool {
+	if t.queued.Inc() > int64(t.queue) {
+		t.queued.Dec()
+		t.rejected.Inc()
+		return false
+	}
+	return true
+}
+
+// wait takes slot for the queued client within queue timeout
+func (t *connLimiter) wait(ctx context.Context) bool {
+	defer t.queued.Dec()
+
+	timer := time.NewTimer(t.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case t.slots <- struct{}{}:
+		t.acquired()
+		return true
+	case <- timer.C:
+	case <- ctx.Done():
+	}
+
+	t.rejected.Inc()
+	return false
+}
+
+func (t *connLimiter) release() {
+	t.active.Dec()
+	<-t.slots
+}
@@ -0,0 +1,178 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnLimit(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// backend answers once and closes, so relay ends when client leaves
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.CopyN(conn, conn, 4)
+			}()
+		}
+	}()
+
+	routes := []Route{
+		{ListenAddr: "127.0.0.1:51650", ForwardAddr: listener.Addr().String(), ConnLimit: &ConnLimit{Max: 1}},
+		{ListenAddr: "127.0.0.1:51651", ForwardAddr: listener.Addr().String(), ConnLimit: &ConnLimit{Max: 1, Action: LimitActionQueue, QueueTimeout: Duration(5 * time.Second)}},
+	}
+
+	var servers []*proxyServer
+	for _, route := range routes {
+		require.NoError(t, route.Validate())
+		server := NewProxyServer(ctx, route, log.Default(), false)
+		require.NoError(t, server.Bind())
+		defer server.Close()
+		go server.Serve()
+		servers = append(servers, server)
+	}
+
+	echo := func(conn net.Conn) error {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(conn, make([]byte, 4))
+		return err
+	}
+
+	for _, addr := range []string{"127.0.0.1:51650", "127.0.0.1:51651"} {
+		first, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer first.Close()
+		require.NoError(t, echo(first))
+
+		second, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer second.Close()
+
+		if addr == "127.0.0.1:51650" {
+			// client over the limit is rejected
+			require.Error(t, echo(second))
+			continue
+		}
+
+		// queued client is served when the first one leaves
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			first.Close()
+		}()
+		require.NoError(t, echo(second))
+	}
+
+	require.Equal(t, int64(1), servers[0].limiter.peak.Load())
+	require.Equal(t, int64(1), servers[0].limiter.rejected.Load())
+	require.Equal(t, int64(1), servers[1].limiter.peak.Load())
+	require.Equal(t, int64(0), servers[1].limiter.rejected.Load())
+}
+
+func TestConnLimitState(t *testing.T) {
+
+	route := Route{ListenAddr: "127.0.0.1:51652", ForwardAddr: "127.0.0.1:51653", ConnLimit: &ConnLimit{Max: 2}}
+	server := NewProxyServer(context.Background(), route, log.Default(), false)
+
+	require.True(t, server.limiter.tryAcquire())
+	require.True(t, server.limiter.tryAcquire())
+	server.limiter.release()
+	require.False(t, server.limiter.enqueue())
+
+	require.Equal(t, &limitState{Max: 2, Active: 1, Peak: 2, Rejected: 1}, server.state().Limit)
+
+	m := newMetricSet()
+	server.collectMetrics(m)
+	var buf bytes.Buffer
+	require.NoError(t, m.writeTo(&buf))
+	for _, line := range []string{
+		`port_proxy_connections_rejected_total{route="127.0.0.1:51652",reason="limit"} 1`,
+		`port_proxy_conn_limit_max{route="127.0.0.1:51652"} 2`,
+		`port_proxy_conn_limit_active{route="127.0.0.1:51652"} 1`,
+		`port_proxy_conn_limit_peak{route="127.0.0.1:51652"} 2`,
+		`port_proxy_conn_limit_queued{route="127.0.0.1:51652"} 0`,
+	} {
+		require.Contains(t, buf.String(), line+"\n")
+	}
+}
+
+func TestUDPSessionLimit(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	echo, err := net.ListenPacket("udp4", "127.0.0.1:51655")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	route := Route{Protocol: ProtocolUDP, ListenAddr: "127.0.0.1:51654", ForwardAddr: "127.0.0.1:51655", ConnLimit: &ConnLimit{Max: 1}}
+	require.NoError(t, route.Validate())
+
+	server := NewUDPServer(ctx, route, log.Default(), false)
+	require.NoError(t, server.Bind())
+	defer server.Close()
+	go server.Serve()
+
+	exchange := func(conn net.Conn) error {
+		conn.SetDeadline(time.Now().Add(300 * time.Millisecond))
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(conn, make([]byte, 4))
+		return err
+	}
+
+	first, err := net.Dial("udp4", route.ListenAddr)
+	require.NoError(t, err)
+	defer first.Close()
+	require.NoError(t, exchange(first))
+
+	// the second client is over the limit, its datagrams are dropped
+	second, err := net.Dial("udp4", route.ListenAddr)
+	require.NoError(t, err)
+	defer second.Close()
+	require.Error(t, exchange(second))
+
+	require.NoError(t, exchange(first))
+	require.Equal(t, &limitState{Max: 1, Active: 1, Peak: 1, Rejected: 1}, server.state().Limit)
+
+	// closed session frees the slot
+	server.closeSessions()
+	require.NoError(t, exchange(second))
+
+	route.ConnLimit = &ConnLimit{Max: 1, Action: LimitActionQueue}
+	require.Error(t, route.Validate())
+}
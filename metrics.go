@@ -0,0 +1,317 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// bucket bounds in seconds
+	connDurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+	dialLatencyBuckets  = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+// histogram counts observations by upper bounds of buckets
+type histogram struct {
+	bounds []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (t *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, bound := range t.bounds {
+		if v <= bound {
+			t.counts[i]++
+		}
+	}
+	t.sum += v
+	t.count++
+}
+
+type metricFamily struct {
+	name    string
+	typ     string
+	help    string
+	samples []string
+}
+
+// metricSet collects samples of all servers by families and writes them in prometheus text format
+type metricSet struct {
+	families []*metricFamily
+	byName   map[string]*metricFamily
+}
+
+func newMetricSet() *metricSet {
+	return &metricSet{byName: make(map[string]*metricFamily)}
+}
+
+func (t *metricSet) family(name, typ, help string) *metricFamily {
+	f, ok := t.byName[name]
+	if !ok {
+		f = &metricFamily{name: name, typ: typ, help: help}
+		t.byName[name] = f
+		t.families = append(t.families, f)
+	}
+	return f
+}
+
+// labels formats pairs of label names and values
+func labels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (t *metricSet) counter(name, help, labels string, value int64) {
+	f := t.family(name, "counter", help)
+	f.samples = append(f.samples, fmt.Sprintf("%s{%s} %d", name, labels, value))
+}
+
+func (t *metricSet) gauge(name, help, labels string, value float64) {
+	f := t.family(name, "gauge", help)
+	if labels == "" {
+		f.samples = append(f.samples, name+" "+formatFloat(value))
+	} else {
+		f.samples = append(f.samples, fmt.Sprintf("%s{%s} %s", name, labels, formatFloat(value)))
+	}
+}
+
+func (t *metricSet) histogram(name, help, labels string, h *histogram) {
+	if h == nil {
+		return
+	}
+	f := t.family(name, "histogram", help)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.bounds {
+		f.samples = append(f.samples, fmt.Sprintf("%s_bucket{%s,le=\"%s\"} %d", name, labels, formatFloat(bound), h.counts[i]))
+	}
+	f.samples = append(f.samples,
+		fmt.Sprintf("%s_bucket{%s,le=\"+Inf\"} %d", name, labels, h.count),
+		fmt.Sprintf("%s_sum{%s} %s", name, labels, formatFloat(h.sum)),
+		fmt.Sprintf("%s_count{%s} %d", name, labels, h.count))
+}
+
+func (t *metricSet) writeTo(w io.Writer) error {
+	var buf bytes.Buffer
+	for _, f := range t.families {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		for _, sample := range f.samples {
+			buf.WriteString(sample)
+			buf.WriteByte('\n')
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// collectBackends adds counters of backends of the upstream, the same address could serve several upstreams of the route,
+// upstream is empty for default backends, sni host or http host and path
+func collectBackends(m *metricSet, route, upstream string, backends []*backend) {
+	for _, b := range backends {
+		l := labels("route", route, "upstream", upstream, "backend", b.addr)
+		healthy := 0.0
+		if b.available() {
+			healthy = 1
+		}
+		m.gauge("port_proxy_backend_up", "Backend is healthy and not ejected by circuit breaker.", l, healthy)
+		m.gauge("port_proxy_backend_connections_active", "Active connections of backend.", l, float64(b.active.Load()))
+		m.counter("port_proxy_backend_connections_total", "Connections served by backend.", l, b.total.Load())
+		m.counter("port_proxy_backend_dial_failures_total", "Failed dials of backend.", l, b.dialFailures.Load())
+		m.counter("port_proxy_backend_early_resets_total", "Connections reset by backend without response.", l, b.earlyResets.Load())
+		m.counter("port_proxy_backend_bytes_in_total", "Bytes sent from clients to backend.", l, b.bytesIn.Load())
+		m.counter("port_proxy_backend_bytes_out_total", "Bytes sent from backend to clients.", l, b.bytesOut.Load())
+		m.histogram("port_proxy_backend_dial_seconds", "Latency of successful backend dials.", l, b.dialLatency)
+	}
+}
+
+func (t *proxyServer) collectMetrics(m *metricSet) {
+
+	route := labels("route", t.route.protocolPrefix()+t.listenAddr)
+
+	m.counter("port_proxy_connections_accepted_total", "Accepted client connections.", route, t.accepted.Load())
+	m.gauge("port_proxy_connections_active", "Active client connections.", route, float64(t.active.Load()))
+
+	rejected := func(reason string, value int64) {
+		m.counter("port_proxy_connections_rejected_total", "Client connections rejected by reason.", route+","+labels("reason", reason), value)
+	}
+	if t.access != nil {
+		rejected("access", t.access.denied.Load())
+	}
+	if t.rateLimiter != nil {
+		rejected("rate", t.rateLimiter.limited.Load())
+	}
+	if t.limiter != nil {
+		rejected("limit", t.limiter.rejected.Load())
+		collectLimit(m, route, t.limiter)
+	}
+	rejected("backend", t.unavailable.Load())
+	rejected("disabled", t.refused.Load())
+
+	m.histogram("port_proxy_connection_duration_seconds", "Duration of served client connections.", route, t.durations)
+	collectTraffic(m, route, t.backends())
+
+	name := t.route.protocolPrefix() + t.listenAddr
+	collectBackends(m, name, "", t.upstream.backends)
+	for _, s := range t.sni {
+		collectBackends(m, name, s.host, s.upstream.backends)
+	}
+	for _, h := range t.httpRoutes {
+		host := h.host
+		if host == "" {
+			host = "*"
+		}
+		collectBackends(m, name, host+h.path, h.upstream.backends)
+	}
+}
+
+func (t *udpServer) collectMetrics(m *metricSet) {
+
+	route := labels("route", t.route.protocolPrefix()+t.listenAddr)
+
+	t.mu.Lock()
+	active := len(t.sessions)
+	t.mu.Unlock()
+
+	m.counter("port_proxy_connections_accepted_total", "Accepted client connections.", route, t.accepted.Load())
+	m.gauge("port_proxy_connections_active", "Active client connections.", route, float64(active))
+	if t.limiter != nil {
+		m.counter("port_proxy_connections_rejected_total", "Client connections rejected by reason.", route+","+labels("reason", "limit"), t.limiter.rejected.Load())
+		collectLimit(m, route, t.limiter)
+	}
+	m.counter("port_proxy_connections_rejected_total", "Client connections rejected by reason.", route+","+labels("reason", "backend"), t.unavailable.Load())
+	m.counter("port_proxy_connections_rejected_total", "Client connections rejected by reason.", route+","+labels("reason", "disabled"), t.refused.Load())
+	collectTraffic(m, route, t.upstream.backends)
+
+	collectBackends(m, t.route.protocolPrefix()+t.listenAddr, "", t.upstream.backends)
+}
+
+// collectTraffic reports totals of the route over backends of all its upstreams
+func collectTraffic(m *metricSet, route string, backends []*backend) {
+	var bytesIn, bytesOut, dialFailures int64
+	for _, b := range backends {
+		bytesIn += b.bytesIn.Load()
+		bytesOut += b.bytesOut.Load()
+		dialFailures += b.dialFailures.Load()
+	}
+	m.counter("port_proxy_bytes_in_total", "Bytes sent from clients to backends of route.", route, bytesIn)
+	m.counter("port_proxy_bytes_out_total", "Bytes sent from backends to clients of route.", route, bytesOut)
+	m.counter("port_proxy_dial_failures_total", "Failed dials of backends of route.", route, dialFailures)
+}
+
+func collectLimit(m *metricSet, route string, limiter *connLimiter) {
+	m.gauge("port_proxy_conn_limit_max", "Connection limit of route.", route, float64(limiter.max))
+	m.gauge("port_proxy_conn_limit_active", "Connections holding slots of the limit.", route, float64(limiter.active.Load()))
+	m.gauge("port_proxy_conn_limit_peak", "Peak of connections holding slots of the limit.", route, float64(limiter.peak.Load()))
+	m.gauge("port_proxy_conn_limit_queued", "Clients waiting for a slot of the limit.", route, float64(limiter.queued.Load()))
+}
+
+// countFDs returns number of open file descriptors, -1 if unknown on this platform
+func countFDs() int {
+	dir, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return -1
+	}
+	// the directory itself is open while reading
+	return len(names) - 1
+}
+
+// writeMetrics writes metrics of all servers and of the process
+func (t *proxyDaemon) writeMetrics(w io.Writer) error {
+
+	m := newMetricSet()
+
+	servers := sortServers(t.serverList())
+	for _, server := range servers {
+		server.collectMetrics(m)
+	}
+
+	m.gauge("port_proxy_routes", "Served routes.", "", float64(len(servers)))
+	m.gauge("process_goroutines", "Number of goroutines.", "", float64(runtime.NumGoroutine()))
+	if fds := countFDs(); fds >= 0 {
+		m.gauge("process_open_fds", "Number of open file descriptors.", "", float64(fds))
+	}
+
+	return m.writeTo(w)
+}
+
+func (t *proxyDaemon) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := t.writeMetrics(w); err != nil {
+		t.log.Printf("Metrics write error, %v\n", err)
+	}
+}
+
+// listenHTTP serves handler on tcp address or unix socket until context is done
+func (t *proxyDaemon) listenHTTP(ctx context.Context, name, addr string, handler http.Handler) error {
+
+	network, path := listenNetwork(addr, false)
+	if network == "unix" {
+		if err := removeStaleSocket(path); err != nil {
+			return errors.Errorf("%s listen address '%s', %v", name, addr, err)
+		}
+	}
+
+	listener, err := net.Listen(network, path)
+	if err != nil {
+		return errors.Errorf("%s listen address is busy '%s', %v", name, addr, err)
+	}
+
+	server := &http.Server{Handler: handler}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	go func() {
+		t.log.Printf("%s started on '%s'\n", name, addr)
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.log.Printf("%s on '%s' ended with error %v\n", name, addr, err)
+		}
+	}()
+	return nil
+}
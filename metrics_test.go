@@ -0,0 +1,165 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+
+	m := newMetricSet()
+	h := newHistogram([]float64{0.1, 1})
+	h.observe(50 * time.Millisecond)
+	h.observe(500 * time.Millisecond)
+	h.observe(5 * time.Second)
+	m.histogram("test_seconds", "Test.", labels("route", `a"b`), h)
+
+	var buf bytes.Buffer
+	require.NoError(t, m.writeTo(&buf))
+	require.Equal(t, `# HELP test_seconds Test.
+# TYPE test_seconds histogram
+test_seconds_bucket{route="a\"b",le="0.1"} 1
+test_seconds_bucket{route="a\"b",le="1"} 2
+test_seconds_bucket{route="a\"b",le="+Inf"} 3
+test_seconds_sum{route="a\"b"} 5.55
+test_seconds_count{route="a\"b"} 3
+`, buf.String())
+}
+
+func TestMetrics(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// backend answers once and closes
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.CopyN(conn, conn, 4)
+			}()
+		}
+	}()
+
+	route := Route{ListenAddr: "127.0.0.1:52050", ForwardAddr: listener.Addr().String()}
+	proxyServer := NewProxyServer(ctx, route, log.Default(), false)
+	require.NoError(t, proxyServer.Bind())
+	defer proxyServer.Close()
+	go proxyServer.Serve()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:52050")
+	require.NoError(t, err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 4))
+	require.NoError(t, err)
+	conn.Close()
+
+	// connection is finished by both sides
+	require.Eventually(t, func() bool { return proxyServer.active.Load() == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	daemon := &proxyDaemon{ctx: ctx, log: log.Default(), servers: map[string]server{routeKey(route): proxyServer}}
+	require.NoError(t, daemon.listenHTTP(ctx, "Metrics", "127.0.0.1:52051", http.HandlerFunc(daemon.serveMetrics)))
+
+	resp, err := http.Get("http://127.0.0.1:52051/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	metrics := string(body)
+
+	backend := fmt.Sprintf(`route="127.0.0.1:52050",upstream="",backend="%s"`, listener.Addr())
+	for _, line := range []string{
+		`port_proxy_connections_accepted_total{route="127.0.0.1:52050"} 1`,
+		`port_proxy_connections_active{route="127.0.0.1:52050"} 0`,
+		`port_proxy_connections_rejected_total{route="127.0.0.1:52050",reason="backend"} 0`,
+		`port_proxy_connection_duration_seconds_count{route="127.0.0.1:52050"} 1`,
+		`port_proxy_bytes_in_total{route="127.0.0.1:52050"} 4`,
+		`port_proxy_bytes_out_total{route="127.0.0.1:52050"} 4`,
+		`port_proxy_dial_failures_total{route="127.0.0.1:52050"} 0`,
+		`port_proxy_backend_up{` + backend + `} 1`,
+		`port_proxy_backend_connections_total{` + backend + `} 1`,
+		`port_proxy_backend_bytes_in_total{` + backend + `} 4`,
+		`port_proxy_backend_bytes_out_total{` + backend + `} 4`,
+		`port_proxy_backend_dial_seconds_count{` + backend + `} 1`,
+		`port_proxy_routes 1`,
+	} {
+		require.Contains(t, metrics, line+"\n")
+	}
+	require.True(t, strings.Contains(metrics, "\nprocess_goroutines "))
+}
+
+func TestMetricsSharedBackend(t *testing.T) {
+
+	// the same backend serves default and sni upstreams and http routes
+	routes := []Route{
+		{
+			ListenAddr:  "127.0.0.1:52052",
+			ForwardAddr: "127.0.0.1:52053",
+			SNI: []SNIRoute{
+				{Host: "app.example.com", ForwardAddr: "127.0.0.1:52053"},
+				{Host: "*.example.org", ForwardAddr: "127.0.0.1:52053"},
+			},
+		},
+		{
+			ListenAddr: "127.0.0.1:52054",
+			Mode:       ModeHTTP,
+			HTTPRoutes: []HTTPRoute{
+				{Path: "/", ForwardAddr: "127.0.0.1:52053"},
+				{Host: "api.example.com", Path: "/users", ForwardAddr: "127.0.0.1:52053"},
+			},
+		},
+	}
+
+	m := newMetricSet()
+	for _, route := range routes {
+		require.NoError(t, route.Validate())
+		NewProxyServer(context.Background(), route, log.Default(), false).collectMetrics(m)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, m.writeTo(&buf))
+	metrics := buf.String()
+
+	series := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(metrics), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name := line[:strings.LastIndexByte(line, ' ')]
+		require.False(t, series[name], name)
+		series[name] = true
+	}
+
+	for _, upstream := range []string{`route="127.0.0.1:52052",upstream=""`, `route="127.0.0.1:52052",upstream="app.example.com"`, `route="127.0.0.1:52052",upstream="*.example.org"`,
+		`route="127.0.0.1:52054",upstream="*/"`, `route="127.0.0.1:52054",upstream="api.example.com/users"`} {
+		require.Contains(t, metrics, `port_proxy_backend_up{`+upstream+`,backend="127.0.0.1:52053"} 1`+"\n")
+	}
+
+	// the same address twice in one pool would repeat series of the backend
+	route := Route{ListenAddr: "127.0.0.1:52052", Backends: []Backend{{Addr: "127.0.0.1:52053"}, {Addr: "127.0.0.1:52053"}}}
+	require.Error(t, route.Validate())
+}
@@ -6,86 +6,366 @@ package proxy
 
 import (
 	"context"
-	"fmt"
+	"encoding/json"
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"sync"
 	"syscall"
+	"time"
 )
 
-type ForwardPort struct {
-	SrcPort int
-	DstPort int
+// ConfigLoader loads and validates the new config on SIGHUP
+type ConfigLoader func() (*Config, error)
+
+// server is the listener of one route with the same lifecycle for all protocols
+type server interface {
+	Route() Route
+	Bind() error
+	// prepare loads settings of the route that could fail, except listen address
+	prepare() error
+	Serve() error
+	Close() error
+	Shutdown(drainTimeout time.Duration) error
+	SetVerbose(verbose bool)
+
+	// adds metrics of the route and its backends
+	collectMetrics(m *metricSet)
+
+	// admin api
+	state() routeState
+	connections() []connState
+	closeConn(id string) bool
+	setEnabled(enabled bool)
 }
 
-func (t ForwardPort) String() string {
-	return fmt.Sprintf("%d:%d", t.SrcPort, t.DstPort)
+func (t *proxyDaemon) newServer(route Route, verbose bool) server {
+	if route.Protocol == ProtocolUDP {
+		server := NewUDPServer(t.ctx, route, t.log, verbose)
+		server.accessLog = t.accessLog
+		return server
+	}
+	server := NewProxyServer(t.ctx, route, t.log, verbose)
+	server.accessLog = t.accessLog
+	return server
 }
 
-func RunProxy(ctx context.Context, ip string, ports []ForwardPort, log *log.Logger, verbose bool) (err error) {
+type proxyDaemon struct {
+	ctx context.Context
+	log *log.Logger
+
+	// nil if access log is disabled
+	accessLog *accessLog
+
+	g *errgroup.Group
+
+	// stops the daemon when a server fails
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	servers map[string]server
+	verbose bool
+}
+
+func RunProxy(ctx context.Context, conf *Config, loader ConfigLoader, log *log.Logger) (err error) {
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	var serverList []*proxyServer
+	g, _ := errgroup.WithContext(ctx)
+
+	t := &proxyDaemon{
+		ctx:     ctx,
+		log:     log,
+		g:       g,
+		cancel:  cancel,
+		servers: make(map[string]server),
+		verbose: conf.Verbose,
+	}
+
+	if conf.AccessLog != "" {
+		if t.accessLog, err = openAccessLog(conf.AccessLog, conf.AccessLogFormat, log); err != nil {
+			return err
+		}
+		defer t.accessLog.Close()
+	}
+
+	var serverList []server
 
-	for _, forward := range ports {
+	for _, route := range conf.Routes {
 
-		listenAddr := fmt.Sprintf("%s:%d", ip, forward.SrcPort)
-		forwardAddr := fmt.Sprintf("%s:%d", ip, forward.DstPort)
-		server := NewProxyServer(ctx, listenAddr, forwardAddr, log, verbose)
+		server := t.newServer(route, conf.Verbose)
 
 		serverList = append(serverList, server)
 	}
 
-	var bindErrors []error
-	for _, server := range serverList {
+	if err := bindAll(serverList, log); err != nil {
+		return err
+	}
 
-		if err := server.Bind(); err != nil {
-			log.Printf("Bind server %v error, %v\n", server, err)
-			bindErrors = append(bindErrors, err)
+	if conf.Metrics != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", t.serveMetrics)
+		if err := t.listenHTTP(ctx, "Metrics", conf.Metrics, mux); err != nil {
+			closeAll(serverList, log)
+			return err
 		}
-
 	}
 
-	if len(bindErrors) > 0 {
-		closeAll(serverList, log)
-		return errors.Errorf("bind errors: %+v", bindErrors)
+	if conf.Admin != "" {
+		if err := t.listenHTTP(ctx, "Admin", conf.Admin, t.adminHandler(conf.AdminToken)); err != nil {
+			closeAll(serverList, log)
+			return err
+		}
 	}
 
-	cnt := 0
-	g, _ := errgroup.WithContext(ctx)
+	// keeps group alive during reloads when all old servers could end before new started,
+	// failed server cancels the context
+	g.Go(func() error {
+		<-ctx.Done()
+		return nil
+	})
 
-	for _, server := range serverList {
-		g.Go(server.Serve)
-		cnt++
-	}
-	log.Printf("Daemon started with %d proxy servers\n", cnt)
+	t.serveAll(serverList)
+	log.Printf("Daemon started with %d proxy servers\n", len(serverList))
 
 	go func() {
 
 		signalCh := make(chan os.Signal, 1)
 		signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		defer signal.Stop(signalCh)
 
 		var signal os.Signal
 
-		select {
-		case signal = <- signalCh:
-		case <- ctx.Done():
-			signal = syscall.SIGABRT
+		for {
+
+			select {
+			case signal = <- signalCh:
+			case <- ctx.Done():
+				signal = syscall.SIGABRT
+			}
+
+			if signal == syscall.SIGHUP && loader != nil {
+				t.reload(loader)
+				continue
+			}
+
+			break
 		}
 
 		log.Printf("Daemon stopped by signal %s\n", signal.String())
 		cancel()
-		closeAll(serverList, log)
+		closeAll(t.serverList(), log)
 	}()
 
 	return g.Wait()
 }
 
-func closeAll(serverList []*proxyServer, log *log.Logger) error {
+func (t *proxyDaemon) serveAll(serverList []server) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, server := range serverList {
+		t.servers[routeKey(server.Route())] = server
+		t.serve(server)
+	}
+}
+
+// serve runs server in the group, closed servers end with nil and any error stops the daemon
+func (t *proxyDaemon) serve(server server) {
+	t.g.Go(func() error {
+		err := server.Serve()
+		if err != nil {
+			t.cancel()
+		}
+		return err
+	})
+}
+
+func (t *proxyDaemon) serverList() []server {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]server, 0, len(t.servers))
+	for _, server := range t.servers {
+		list = append(list, server)
+	}
+	return list
+}
+
+// reload binds new routes, drains removed ones and keeps unchanged routes with their connections
+func (t *proxyDaemon) reload(loader ConfigLoader) {
+
+	if t.accessLog != nil {
+		if err := t.accessLog.reopen(); err != nil {
+			t.log.Printf("Reload %v\n", err)
+		}
+	}
+
+	conf, err := loader()
+	if err != nil {
+		t.log.Printf("Reload rejected, %v\n", err)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	next := make(map[string]Route)
+	for _, route := range conf.Routes {
+		next[routeKey(route)] = route
+	}
+
+	var removed []server
+	for key, server := range t.servers {
+		if _, ok := next[key]; !ok {
+			removed = append(removed, server)
+		}
+	}
+
+	var added []server
+	for key, route := range next {
+		if _, ok := t.servers[key]; !ok {
+			added = append(added, t.newServer(route, conf.Verbose))
+		}
+	}
+
+	unchanged := len(t.servers) - len(removed)
+	t.log.Printf("Reload config: added %s, removed %s, unchanged %d\n", FormatRoutes(routesOf(added)), FormatRoutes(routesOf(removed)), unchanged)
+
+	// running routes are kept if new ones have invalid certificates or lists
+	for _, server := range added {
+		if err := server.prepare(); err != nil {
+			t.log.Printf("Reload rejected, route %s, %v\n", FormatRoutes([]Route{server.Route()}), err)
+			return
+		}
+	}
+
+	// changed route could use the listen address of removed one, it is bound after removed is closed
+	removedAddrs := make(map[string]server)
+	for _, server := range removed {
+		removedAddrs[listenKey(server.Route())] = server
+	}
+	var free, taking, released []server
+	taken := make(map[string]bool)
+	for _, server := range added {
+		key := listenKey(server.Route())
+		if old, ok := removedAddrs[key]; ok {
+			taking = append(taking, server)
+			released = append(released, old)
+			taken[key] = true
+		} else {
+			free = append(free, server)
+		}
+	}
+
+	if err := bindAll(free, t.log); err != nil {
+		t.log.Printf("Reload failed, keep running routes, %v\n", err)
+		return
+	}
+
+	drainTimeout := time.Duration(conf.DrainTimeout)
+	for _, server := range released {
+		server.Shutdown(drainTimeout)
+	}
+
+	if err := bindAll(taking, t.log); err != nil {
+
+		t.log.Printf("Reload failed, restore removed routes, %v\n", err)
+		closeAll(free, t.log)
+
+		// connections of closed servers drain, the new ones are accepted by restored servers
+		for _, server := range released {
+			delete(t.servers, routeKey(server.Route()))
+
+			restored := t.newServer(server.Route(), t.verbose)
+			if err := restored.Bind(); err != nil {
+				t.log.Printf("Restore server %v error, %v\n", restored, err)
+				continue
+			}
+
+			t.servers[routeKey(restored.Route())] = restored
+			t.serve(restored)
+		}
+		return
+	}
+
+	for _, server := range removed {
+		if !taken[listenKey(server.Route())] {
+			server.Shutdown(drainTimeout)
+		}
+		delete(t.servers, routeKey(server.Route()))
+	}
+
+	for _, server := range t.servers {
+		server.SetVerbose(conf.Verbose)
+	}
+
+	for _, server := range added {
+		t.servers[routeKey(server.Route())] = server
+		t.serve(server)
+	}
+
+	t.verbose = conf.Verbose
+}
+
+// routeKey identifies route with all its options, so any change is a new route
+func routeKey(route Route) string {
+	key, _ := json.Marshal(route)
+	return string(key)
+}
+
+// listenKey is the listen address of the route with protocol, routes with the same key could not be bound together
+func listenKey(route Route) string {
+	return route.protocolPrefix() + route.ListenAddr
+}
+
+// routesOf returns routes of servers ordered by listen address
+func routesOf(serverList []server) []Route {
+	routes := make([]Route, 0, len(serverList))
+	for _, server := range sortServers(serverList) {
+		routes = append(routes, server.Route())
+	}
+	return routes
+}
+
+// sortServers orders servers by listen address
+func sortServers(serverList []server) []server {
+	sort.Slice(serverList, func(i, j int) bool {
+		iHost, iPort, _ := splitAddr(serverList[i].Route().ListenAddr)
+		jHost, jPort, _ := splitAddr(serverList[j].Route().ListenAddr)
+		if iHost != jHost {
+			return iHost < jHost
+		}
+		return iPort < jPort
+	})
+	return serverList
+}
+
+// bindAll binds all servers or nothing
+func bindAll(serverList []server, log *log.Logger) error {
+
+	var bindErrors []error
+	for _, server := range serverList {
+
+		if err := server.Bind(); err != nil {
+			log.Printf("Bind server %v error, %v\n", server, err)
+			bindErrors = append(bindErrors, err)
+		}
+
+	}
+
+	if len(bindErrors) > 0 {
+		closeAll(serverList, log)
+		return errors.Errorf("bind errors: %+v", bindErrors)
+	}
+
+	return nil
+}
+
+func closeAll(serverList []server, log *log.Logger) error {
 
 	for _, server := range serverList {
 		if err := server.Close(); err != nil {
@@ -94,4 +374,4 @@ func closeAll(serverList []*proxyServer, log *log.Logger) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
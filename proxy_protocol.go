@@ -0,0 +1,370 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// signature of PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV2Command = 0x21 // version 2, PROXY command
+
+	proxyV2Unspec = 0x00
+	proxyV2TCP4   = 0x11
+	proxyV2TCP6   = 0x21
+
+	proxyV2TypeAuthority = 0x02 // TLS server name
+	proxyV2TypeUniqueID  = 0x05 // connection id
+)
+
+func checkProxyProtocol(version string) error {
+	switch version {
+	case "", ProxyProtocolV1, ProxyProtocolV2:
+		return nil
+	default:
+		return errors.Errorf("unknown proxy protocol version '%s', expected %s or %s", version, ProxyProtocolV1, ProxyProtocolV2)
+	}
+}
+
+// writeProxyHeader sends PROXY protocol header with client address of the connection,
+// v2 header carries TLS server name and connection id
+func writeProxyHeader(w io.Writer, version string, info *connInfo) error {
+
+	var header []byte
+	if version == ProxyProtocolV2 {
+		header = proxyHeaderV2(info)
+	} else {
+		header = proxyHeaderV1(info)
+	}
+
+	_, err := w.Write(header)
+	return err
+}
+
+// proxyAddrs returns client and proxy TCP addresses of the same family, nil if unknown
+func proxyAddrs(info *connInfo) (*net.TCPAddr, *net.TCPAddr) {
+
+	src, ok := info.client.(*net.TCPAddr)
+	if !ok {
+		return nil, nil
+	}
+	dst, ok := info.local.(*net.TCPAddr)
+	if !ok {
+		return nil, nil
+	}
+
+	if src.IP.To4() != nil && dst.IP.To4() != nil {
+		return &net.TCPAddr{IP: src.IP.To4(), Port: src.Port}, &net.TCPAddr{IP: dst.IP.To4(), Port: dst.Port}
+	}
+	return &net.TCPAddr{IP: src.IP.To16(), Port: src.Port}, &net.TCPAddr{IP: dst.IP.To16(), Port: dst.Port}
+}
+
+func proxyHeaderV1(info *connInfo) []byte {
+
+	src, dst := proxyAddrs(info)
+	if src == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family := "TCP4"
+	if len(src.IP) == net.IPv6len {
+		family = "TCP6"
+	}
+
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src.IP, dst.IP, src.Port, dst.Port))
+}
+
+func proxyHeaderV2(info *connInfo) []byte {
+
+	var family byte
+	var addrs []byte
+
+	src, dst := proxyAddrs(info)
+	switch {
+	case src == nil:
+		family = proxyV2Unspec
+	case len(src.IP) == net.IPv4len:
+		family = proxyV2TCP4
+		addrs = append(append(addrs, src.IP...), dst.IP...)
+	default:
+		family = proxyV2TCP6
+		addrs = append(append(addrs, src.IP...), dst.IP...)
+	}
+	if src != nil {
+		addrs = append(addrs, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+	}
+
+	if info.serverName != "" {
+		addrs = appendTLV(addrs, proxyV2TypeAuthority, []byte(info.serverName))
+	}
+	if info.id != "" {
+		addrs = appendTLV(addrs, proxyV2TypeUniqueID, []byte(info.id))
+	}
+
+	header := make([]byte, 0, len(proxyV2Signature)+4+len(addrs))
+	header = append(header, proxyV2Signature...)
+	header = append(header, proxyV2Command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[len(header)-2:], uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func appendTLV(buf []byte, typ byte, value []byte) []byte {
+	return append(append(buf, typ, byte(len(value)>>8), byte(len(value))), value...)
+}
+
+var DefaultProxyHeaderTimeout = Duration(5 * time.Second)
+
+// AcceptProxy parses PROXY protocol v1 or v2 header of clients connecting through load balancer
+type AcceptProxy struct {
+
+	// CIDRs or IPs allowed to send the header, others are rejected, required for tcp listener
+	Trusted []string `json:"trusted,omitempty" yaml:"trusted,omitempty"`
+
+	// time to receive the header
+	Timeout Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+func (t *AcceptProxy) Validate() error {
+	if _, err := parseCIDRs(t.Trusted); err != nil {
+		return errors.Errorf("invalid trusted proxy, %v", err)
+	}
+	if t.Timeout < 0 {
+		return errors.New("negative proxy header timeout")
+	}
+	return nil
+}
+
+// parseCIDRs parses networks, single IPs are networks of one address
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.Errorf("invalid ip '%s'", s)
+			}
+			if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyHeader is the parsed PROXY protocol header, nil addresses are unknown
+type proxyHeader struct {
+	src        net.Addr
+	dst        net.Addr
+	serverName string
+}
+
+// readProxyHeader reads PROXY protocol header v1 or v2
+func readProxyHeader(r *bufio.Reader) (*proxyHeader, error) {
+
+	sig, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if sig[0] == proxyV2Signature[0] {
+		return readProxyHeaderV2(r)
+	}
+	return readProxyHeaderV1(r)
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (*proxyHeader, error) {
+
+	// max length of v1 header
+	const maxLen = 107
+
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxLen {
+			return nil, errors.New("too long proxy protocol v1 header")
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("invalid proxy protocol header")
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return &proxyHeader{}, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, errors.Errorf("unknown proxy protocol v1 family '%s'", fields[1])
+	}
+
+	if len(fields) != 6 {
+		return nil, errors.New("invalid proxy protocol v1 header")
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, errors.New("invalid proxy protocol v1 addresses")
+	}
+
+	return &proxyHeader{
+		src: &net.TCPAddr{IP: srcIP, Port: int(srcPort)},
+		dst: &net.TCPAddr{IP: dstIP, Port: int(dstPort)},
+	}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (*proxyHeader, error) {
+
+	head := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(head[:len(proxyV2Signature)], proxyV2Signature) {
+		return nil, errors.New("invalid proxy protocol header")
+	}
+
+	command, family := head[12], head[13]
+	if command>>4 != 2 {
+		return nil, errors.Errorf("unknown proxy protocol version %d", command>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	header := &proxyHeader{}
+
+	// LOCAL command is sent by load balancer itself, like health checks
+	if command&0xF == 0 {
+		return header, nil
+	}
+
+	var addrLen int
+	switch family >> 4 {
+	case 1:
+		addrLen = 2*net.IPv4len + 4
+	case 2:
+		addrLen = 2*net.IPv6len + 4
+	case 3:
+		// unix addresses are not useful for backends
+		addrLen = 216
+	}
+
+	if len(payload) < addrLen {
+		return nil, errors.New("too short proxy protocol v2 header")
+	}
+
+	if n := (addrLen - 4) / 2; family>>4 == 1 || family>>4 == 2 {
+		header.src = &net.TCPAddr{IP: net.IP(payload[:n]), Port: int(binary.BigEndian.Uint16(payload[2*n:]))}
+		header.dst = &net.TCPAddr{IP: net.IP(payload[n : 2*n]), Port: int(binary.BigEndian.Uint16(payload[2*n+2:]))}
+	}
+
+	for tlvs := payload[addrLen:]; len(tlvs) >= 3; {
+		typ, n := tlvs[0], int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+n {
+			return nil, errors.New("invalid proxy protocol v2 tlv")
+		}
+		if typ == proxyV2TypeAuthority {
+			header.serverName = string(tlvs[3 : 3+n])
+		}
+		tlvs = tlvs[3+n:]
+	}
+
+	return header, nil
+}
+
+// proxiedConn is client connection with addresses of PROXY protocol header
+type proxiedConn struct {
+	net.Conn
+	reader io.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (t *proxiedConn) Read(p []byte) (int, error) {
+	return t.reader.Read(p)
+}
+
+func (t *proxiedConn) RemoteAddr() net.Addr {
+	return t.remote
+}
+
+func (t *proxiedConn) LocalAddr() net.Addr {
+	return t.local
+}
+
+// acceptProxyHeader reads PROXY protocol header of the trusted client and returns connection with real addresses
+func (t *proxyServer) acceptProxyHeader(conn net.Conn) (net.Conn, string, error) {
+
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !containsIP(t.trustedProxies, tcpAddr.IP) {
+		return nil, "", errors.Errorf("untrusted proxy '%s'", tcpAddr)
+	}
+
+	timeout := time.Duration(t.route.AcceptProxy.Timeout)
+	if timeout == 0 {
+		timeout = time.Duration(DefaultProxyHeaderTimeout)
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	reader := bufio.NewReader(conn)
+	header, err := readProxyHeader(reader)
+	if err != nil {
+		return nil, "", errors.Errorf("proxy protocol header of '%s', %v", addrString(conn.RemoteAddr()), err)
+	}
+
+	// bytes after the header are already in the buffer
+	buffered, _ := reader.Peek(reader.Buffered())
+	proxied := &proxiedConn{
+		Conn:   conn,
+		reader: io.MultiReader(bytes.NewReader(buffered), conn),
+		remote: conn.RemoteAddr(),
+		local:  conn.LocalAddr(),
+	}
+	if header.src != nil {
+		proxied.remote, proxied.local = header.src, header.dst
+	}
+
+	return proxied, header.serverName, nil
+}
@@ -0,0 +1,202 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+)
+
+func TestProxyHeader(t *testing.T) {
+
+	info := &connInfo{
+		id:     "abc-1",
+		client: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 51000},
+		local:  &net.TCPAddr{IP: net.ParseIP("::ffff:198.51.100.1"), Port: 443},
+	}
+	require.Equal(t, "PROXY TCP4 192.0.2.10 198.51.100.1 51000 443\r\n", string(proxyHeaderV1(info)))
+
+	info6 := &connInfo{
+		client: &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 51000},
+		local:  &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+	}
+	require.Equal(t, "PROXY TCP6 2001:db8::10 2001:db8::1 51000 443\r\n", string(proxyHeaderV1(info6)))
+
+	unknown := &connInfo{client: &net.UnixAddr{Name: "@", Net: "unix"}}
+	require.Equal(t, "PROXY UNKNOWN\r\n", string(proxyHeaderV1(unknown)))
+
+	info.serverName = "app.example.com"
+	header := proxyHeaderV2(info)
+
+	expected := append([]byte{}, proxyV2Signature...)
+	expected = append(expected, 0x21, 0x11, 0, 12+3+15+3+5)
+	expected = append(expected, 192, 0, 2, 10, 198, 51, 100, 1, 0xc7, 0x38, 0x01, 0xbb)
+	expected = append(expected, 0x02, 0, 15)
+	expected = append(expected, "app.example.com"...)
+	expected = append(expected, 0x05, 0, 5)
+	expected = append(expected, "abc-1"...)
+	require.Equal(t, expected, header)
+
+	header = proxyHeaderV2(unknown)
+	require.Equal(t, append(append([]byte{}, proxyV2Signature...), 0x21, 0x00, 0, 0), header)
+}
+
+func TestSendProxy(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	headers := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		headers <- line
+	}()
+
+	route := Route{ListenAddr: "127.0.0.1:51350", ForwardAddr: listener.Addr().String(), SendProxy: ProxyProtocolV1}
+	require.NoError(t, route.Validate())
+
+	server := NewProxyServer(ctx, route, log.Default(), false)
+	require.NoError(t, server.Bind())
+	defer server.Close()
+	go server.Serve()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:51350")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	client := conn.LocalAddr().(*net.TCPAddr)
+	require.Equal(t, fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %d 51350\r\n", client.Port), <-headers)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+
+	info := &connInfo{
+		id:         "abc-1",
+		client:     &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 51000},
+		local:      &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		serverName: "app.example.com",
+	}
+
+	for _, header := range [][]byte{proxyHeaderV1(info), proxyHeaderV2(info)} {
+		reader := bufio.NewReader(bytes.NewReader(append(header, "data"...)))
+		parsed, err := readProxyHeader(reader)
+		require.NoError(t, err)
+		require.Equal(t, info.client.String(), parsed.src.String())
+		require.Equal(t, info.local.String(), parsed.dst.String())
+		rest, _ := ioutil.ReadAll(reader)
+		require.Equal(t, "data", string(rest))
+	}
+
+	parsed, err := readProxyHeader(bufio.NewReader(bytes.NewReader(proxyHeaderV2(info))))
+	require.NoError(t, err)
+	require.Equal(t, "app.example.com", parsed.serverName)
+
+	parsed, err = readProxyHeader(bufio.NewReader(bytes.NewReader([]byte("PROXY UNKNOWN\r\n"))))
+	require.NoError(t, err)
+	require.Nil(t, parsed.src)
+
+	for _, header := range []string{"GET / HTTP/1.1\r\n", "PROXY TCP4 1.2.3.4 5.6.7.8 70000 80\r\n", "PROXY TCP4 1.2.3.4\r\n"} {
+		_, err := readProxyHeader(bufio.NewReader(bytes.NewReader([]byte(header))))
+		require.Error(t, err, header)
+	}
+}
+
+func TestAcceptProxy(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			header, _ := reader.ReadString('\n')
+			data := make([]byte, 4)
+			io.ReadFull(reader, data)
+			conn.Close()
+			received <- header + string(data)
+		}
+	}()
+
+	routes := []Route{
+		{
+			ListenAddr:  "127.0.0.1:51450",
+			ForwardAddr: listener.Addr().String(),
+			AcceptProxy: &AcceptProxy{Trusted: []string{"127.0.0.0/8"}},
+			SendProxy:   ProxyProtocolV1,
+		},
+		{
+			ListenAddr:  "127.0.0.1:51451",
+			ForwardAddr: listener.Addr().String(),
+			AcceptProxy: &AcceptProxy{Trusted: []string{"10.0.0.1"}},
+		},
+	}
+
+	for _, route := range routes {
+		require.NoError(t, route.Validate())
+		server := NewProxyServer(ctx, route, log.Default(), false)
+		require.NoError(t, server.Bind())
+		defer server.Close()
+		go server.Serve()
+	}
+
+	// real client address is sent to backend
+	conn, err := net.Dial("tcp", "127.0.0.1:51450")
+	require.NoError(t, err)
+	conn.Write([]byte("PROXY TCP4 192.0.2.10 198.51.100.1 51000 443\r\nping"))
+	require.Equal(t, "PROXY TCP4 192.0.2.10 198.51.100.1 51000 443\r\nping", <-received)
+	conn.Close()
+
+	// untrusted source is rejected
+	conn, err = net.Dial("tcp", "127.0.0.1:51451")
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 192.0.2.10 198.51.100.1 51000 443\r\nping"))
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+}
+
+func TestAcceptProxyTrusted(t *testing.T) {
+
+	// header of any source is not trusted by default
+	route := Route{ListenAddr: "127.0.0.1:51452", ForwardAddr: "127.0.0.1:51453", AcceptProxy: &AcceptProxy{}}
+	require.Error(t, route.Validate())
+
+	route.ListenAddr = "unix:/tmp/proxy.sock"
+	require.NoError(t, route.Validate())
+
+	// empty list denies tcp sources if validation is skipped
+	server := NewProxyServer(context.Background(), Route{ListenAddr: "127.0.0.1:51452", ForwardAddr: "127.0.0.1:51453", AcceptProxy: &AcceptProxy{}}, log.Default(), false)
+	require.NoError(t, server.prepare())
+	client, proxied := net.Pipe()
+	defer client.Close()
+	_, _, err := server.acceptProxyHeader(&proxiedConn{Conn: proxied, reader: proxied, remote: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 50000}})
+	require.Error(t, err)
+}
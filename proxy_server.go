@@ -6,12 +6,14 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/pkg/errors"
 	"io"
 	"log"
 	"net"
 	"go.uber.org/atomic"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -25,45 +27,242 @@ type ReadTimeoutKey struct {
 type WriteTimeoutKey struct {
 }
 
+// how often held clients look for ejected backends to come back
+var downHoldPoll = 100 * time.Millisecond
+
+// connection ids are unique within the process and distinct between restarts
+var (
+	connIDPrefix  = strconv.FormatInt(time.Now().Unix(), 36)
+	connIDCounter atomic.Uint64
+)
+
+// connInfo describes accepted client connection
+type connInfo struct {
+	id    string
+	start time.Time
+
+	// client and proxy addresses of the connection
+	client net.Addr
+	local  net.Addr
+
+	// TLS server name of the client, empty if unknown
+	serverName string
+
+	// bytes from and to the client, address of the last dialed backend
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	backend  atomic.String
+
+	// first side that closed the connection, see closing
+	closeMu     sync.Mutex
+	closedBy    string
+	closeReason string
+	closeErr    string
+}
+
+func nextConnID() string {
+	return connIDPrefix + "-" + strconv.FormatUint(connIDCounter.Inc(), 10)
+}
+
+func newConnInfo(conn net.Conn) *connInfo {
+	return &connInfo{
+		id:     nextConnID(),
+		start:  time.Now(),
+		client: conn.RemoteAddr(),
+		local:  conn.LocalAddr(),
+	}
+}
+
 type proxyServer struct {
 
 	ctx context.Context
 
+	route Route
+
 	listenAddr string
 	lc         net.ListenConfig
 	listener   net.Listener
+	tlsConfig  *tls.Config
+	prepared   bool
+
+	// sources allowed to send PROXY protocol header
+	trustedProxies []*net.IPNet
 
 	cancelFn    context.CancelFunc
 
 	forwardAddr string
+	upstream    *upstream
+	upstreamTLS *tls.Config
+
+	// upstreams by server name or http request, upstream is default one
+	sni        []sniUpstream
+	httpRoutes []httpUpstream
+	httpPool   *httpPool
 
 	log      *log.Logger
-	verbose  bool
+	verbose  atomic.Bool
+
+	clientIdleTimeout   time.Duration
+	upstreamIdleTimeout time.Duration
+	handshakeTimeout    time.Duration
+	dialTimeout         time.Duration
+
+	// nil if all clients are allowed
+	access *accessList
+
+	// nil if connections are unlimited
+	limiter     *connLimiter
+	rateLimiter *rateLimiter
+	shaper      *shaper
+
+	// connections accepted, being served and rejected without backend
+	accepted    atomic.Int64
+	active      atomic.Int64
+	unavailable atomic.Int64
+	durations   *histogram
 
-	readTimeout  time.Duration
-	writeTimeout time.Duration
+	// nil if access log is disabled
+	accessLog *accessLog
+
+	// connections closed at once while route is disabled by admin api
+	disabled atomic.Bool
+	refused  atomic.Int64
+
+	// relayed connections by id for admin api
+	trackMu sync.Mutex
+	tracked map[string]*meteredConn
+
+	// active connections of this server, waited on shutdown
+	conns        sync.WaitGroup
+	drainTimeout atomic.Duration
 
 	running    atomic.Bool
 	closeOnce  sync.Once
 }
 
-func NewProxyServer(ctx context.Context, listenAddr, forwardAddr string, log *log.Logger, verbose bool) *proxyServer {
-	return &proxyServer{
+func NewProxyServer(ctx context.Context, route Route, log *log.Logger, verbose bool) *proxyServer {
+	upstream := newUpstream(route)
+	t := &proxyServer{
 		ctx: ctx,
-		listenAddr: listenAddr,
-		forwardAddr: forwardAddr,
+		route: route,
+		listenAddr: route.ListenAddr,
+		forwardAddr: upstream.String(),
+		upstream: upstream,
 		log: log,
-		verbose: verbose,
+		clientIdleTimeout: time.Duration(route.ClientIdleTimeout),
+		upstreamIdleTimeout: time.Duration(route.UpstreamIdleTimeout),
+		handshakeTimeout: time.Duration(route.HandshakeTimeout),
+		dialTimeout: time.Duration(route.DialTimeout),
+		durations: newHistogram(connDurationBuckets),
+		tracked: make(map[string]*meteredConn),
+	}
+	if t.handshakeTimeout == 0 {
+		t.handshakeTimeout = time.Duration(DefaultHandshakeTimeout)
+	}
+	if route.ConnLimit != nil {
+		t.limiter = newConnLimiter(*route.ConnLimit)
+	}
+	if route.RateLimit != nil {
+		t.rateLimiter = newRateLimiter(*route.RateLimit)
+	}
+	if route.Bandwidth != nil {
+		t.shaper = newShaper(*route.Bandwidth)
 	}
+	if len(route.SNI) > 0 {
+		list := make([]string, 0, len(route.SNI)+1)
+		for _, s := range route.SNI {
+			r := route
+			r.ForwardAddr, r.Backends = s.ForwardAddr, s.Backends
+			t.sni = append(t.sni, sniUpstream{host: strings.ToLower(s.Host), upstream: newUpstream(r)})
+			list = append(list, s.String())
+		}
+		if len(upstream.backends) > 0 {
+			list = append(list, "*="+t.forwardAddr)
+		}
+		t.forwardAddr = "sni(" + strings.Join(list, " ") + ")"
+	}
+	if route.Mode == ModeHTTP {
+		list := make([]string, 0, len(route.HTTPRoutes)+1)
+		for _, h := range route.HTTPRoutes {
+			r := route
+			r.ForwardAddr, r.Backends = h.ForwardAddr, h.Backends
+			t.httpRoutes = append(t.httpRoutes, httpUpstream{host: strings.ToLower(h.Host), path: h.Path, upstream: newUpstream(r)})
+			list = append(list, h.String())
+		}
+		if len(upstream.backends) > 0 {
+			list = append(list, "*="+t.forwardAddr)
+		}
+		t.forwardAddr = "http(" + strings.Join(list, " ") + ")"
+		t.httpPool = newHTTPPool()
+	}
+	t.verbose.Store(verbose)
+	return t
+}
+
+func (t *proxyServer) Route() Route {
+	return t.route
+}
+
+func (t *proxyServer) SetVerbose(verbose bool) {
+	t.verbose.Store(verbose)
 }
 
 func (t *proxyServer) String() string {
 	return fmt.Sprintf("ProxyServer {%s to %s}", t.listenAddr, t.forwardAddr)
 }
 
+// prepare loads certificates and lists of the route, so reload could check them before closing running routes
+func (t *proxyServer) prepare() (err error) {
+
+	if t.prepared {
+		return nil
+	}
+
+	// tls starts on accepted connection after PROXY protocol header
+	if t.route.TLS != nil {
+		t.tlsConfig, err = t.route.TLS.config(t.log, t.listenAddr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if t.route.AcceptProxy != nil {
+		t.trustedProxies, err = parseCIDRs(t.route.AcceptProxy.Trusted)
+		if err != nil {
+			return err
+		}
+	}
+
+	if t.route.restricted() {
+		t.access, err = newAccessList(t.route, t.log)
+		if err != nil {
+			return err
+		}
+	}
+
+	if t.route.UpstreamTLS != nil {
+		t.upstreamTLS, err = t.route.UpstreamTLS.config()
+		if err != nil {
+			return err
+		}
+	}
+
+	t.prepared = true
+	return nil
+}
+
 func (t *proxyServer) Bind() (err error) {
 
-	t.listener, err = t.lc.Listen(t.ctx, "tcp4", t.listenAddr)
+	if err := t.prepare(); err != nil {
+		return err
+	}
+
+	network, addr := listenNetwork(t.listenAddr, t.route.IPv6Only)
+	if network == "unix" {
+		t.listener, err = t.listenUnix(t.ctx, addr)
+	} else {
+		t.listener, err = t.lc.Listen(t.ctx, network, addr)
+	}
 	if err != nil {
 		return errors.Errorf("Listen address is busy '%s', %v", t.listenAddr, err)
 	}
@@ -91,17 +290,43 @@ func (t *proxyServer) Serve() (err error) {
 
 	t.log.Printf("ProxyServe Started '%s' -> '%s'\n", t.listenAddr, t.forwardAddr)
 
+	for _, b := range t.backends() {
+		if b.check != nil {
+			checker := &healthChecker{check: *b.check, backend: b, server: t}
+			go checker.run(serveCtx)
+		}
+	}
+
 	t.running.Store(true)
 	err = t.doServe(serveCtx)
 	t.running.Store(false)
 
+	t.drain(serveCtx)
 	t.cancelFn()
 
+	if t.httpPool != nil {
+		t.httpPool.close()
+	}
+
 	if err != nil && strings.Contains(err.Error(), "closed") {
 		err = nil
 	}
 
 	t.log.Printf("ProxyServe Ended '%s' -> '%s' with error %v\n", t.listenAddr, t.forwardAddr, err)
+	if t.verbose.Load() {
+		if t.access != nil {
+			t.log.Printf("ProxyServe '%s' %v\n", t.listenAddr, t.access)
+		}
+		if t.limiter != nil {
+			t.log.Printf("ProxyServe '%s' %v\n", t.listenAddr, t.limiter)
+		}
+		if t.rateLimiter != nil {
+			t.log.Printf("ProxyServe '%s' %v\n", t.listenAddr, t.rateLimiter)
+		}
+		for _, b := range t.backends() {
+			t.log.Printf("ProxyServe '%s' %v\n", t.listenAddr, b)
+		}
+	}
 	return err
 }
 
@@ -111,23 +336,245 @@ func (t *proxyServer) doServe(ctx context.Context) error {
 		if err != nil {
 			return err
 		}
-		go t.serveConn(ctx, conn)
+		t.accepted.Inc()
+
+		info := newConnInfo(conn)
+
+		if t.disabled.Load() {
+			t.refused.Inc()
+			conn.Close()
+			t.logRejected(info, reasonDisabled)
+			continue
+		}
+
+		// client behind load balancer is known after PROXY protocol header
+		if t.access != nil && t.route.AcceptProxy == nil && t.denied(conn) {
+			t.logRejected(info, reasonAccess)
+			continue
+		}
+
+		if t.rateLimiter != nil && t.route.AcceptProxy == nil && t.rateLimited(conn) {
+			if t.rateLimiter.tarpit > 0 {
+				go func() {
+					t.rejectLimited(ctx, conn)
+					t.logRejected(info, reasonRateLimit)
+				}()
+			} else {
+				conn.Close()
+				t.logRejected(info, reasonRateLimit)
+			}
+			continue
+		}
+
+		// clients over the limit wait in own goroutines, their number is bounded by the queue
+		queued := false
+		if t.limiter != nil && !t.limiter.tryAcquire() {
+			if t.limiter.full.CAS(false, true) {
+				t.log.Printf("ProxyServe '%s' connection limit %d reached\n", t.listenAddr, t.limiter.max)
+			}
+			if queued = t.limiter.enqueue(); !queued {
+				t.limitRejected(conn, "connection limit reached")
+				t.logRejected(info, reasonConnLimit)
+				continue
+			}
+		}
+
+		t.conns.Add(1)
+		go func() {
+			defer t.conns.Done()
+			if queued && !t.limiter.wait(ctx) {
+				t.limitRejected(conn, "connection queue timeout")
+				t.logRejected(info, reasonQueueTimeout)
+				return
+			}
+			if t.limiter != nil {
+				defer t.limiter.release()
+			}
+
+			t.active.Inc()
+			start := time.Now()
+			t.serveConn(ctx, conn, info)
+			t.durations.observe(time.Since(start))
+			t.active.Dec()
+		}()
 	}
 	return nil
 }
 
-func (t *proxyServer) serveConn(ctx context.Context, conn net.Conn) error {
+func (t *proxyServer) limitRejected(conn net.Conn, reason string) {
+	if t.verbose.Load() {
+		t.log.Printf("ProxyServe '%s' rejected client '%s', %s %v\n", t.listenAddr, addrString(conn.RemoteAddr()), reason, t.limiter)
+	}
+	conn.Close()
+}
+
+// drain waits for active connections not longer than drain timeout
+func (t *proxyServer) drain(ctx context.Context) {
+
+	timeout := t.drainTimeout.Load()
+	if timeout <= 0 {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		t.conns.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <- done:
+	case <- ctx.Done():
+	case <- timer.C:
+		t.log.Printf("ProxyServe '%s' -> '%s' drain timeout, close active connections\n", t.listenAddr, t.forwardAddr)
+	}
+}
+
+func (t *proxyServer) serveConn(ctx context.Context, conn net.Conn, info *connInfo) (err error) {
+
+	defer func() {
+		t.logAccess(info, err)
+	}()
+
+	conn = newIdleConn(conn, t.clientIdleTimeout, func() {
+		info.closing(closedByProxy, reasonClientIdle, nil)
+	})
 	defer conn.Close()
 
-	if d, ok := ctx.Value(ReadTimeoutKey{}).(time.Duration); ok && d != 0 {
-		conn.SetReadDeadline(time.Now().Add(d))
+	metered := &meteredConn{Conn: conn, info: info}
+	conn = metered
+
+	if t.route.AcceptProxy != nil {
+		proxied, name, err := t.acceptProxyHeader(conn)
+		if err != nil {
+			t.log.Printf("ProxyServe '%s' rejected client, %v\n", t.listenAddr, err)
+			info.closing(closedByProxy, reasonProxyHeader, err)
+			return err
+		}
+		conn = proxied
+		info.client, info.local, info.serverName = conn.RemoteAddr(), conn.LocalAddr(), name
+
+		if t.access != nil && t.denied(conn) {
+			err := errors.Errorf("denied client '%s'", addrString(conn.RemoteAddr()))
+			info.closing(closedByProxy, reasonAccess, err)
+			return err
+		}
+
+		if t.rateLimiter != nil && t.rateLimited(conn) {
+			t.rejectLimited(ctx, conn)
+			err := errors.Errorf("rate limited client '%s'", addrString(conn.RemoteAddr()))
+			info.closing(closedByProxy, reasonRateLimit, err)
+			return err
+		}
+	}
+
+	// bandwidth is shaped under tls by the real client address
+	if t.shaper != nil {
+		shaped := t.shaper.wrap(ctx, conn)
+		defer shaped.release()
+		conn = shaped
+	}
+
+	// TLS handshake and ClientHello of SNI route are limited, afterwards only idle timeout applies
+	conn.SetDeadline(time.Now().Add(t.handshakeTimeout))
+
+	if t.tlsConfig != nil {
+		conn = tls.Server(conn, t.tlsConfig)
+	}
+
+	// finish handshake before dialing upstream, so failed clients never reach backends
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			if t.verbose.Load() {
+				t.log.Printf("ProxyServe '%s' tls handshake with '%s' error, %v\n", t.listenAddr, addrString(conn.RemoteAddr()), err)
+			}
+			info.closing(closedByProxy, reasonHandshake, err)
+			return err
+		}
+		if name := tlsConn.ConnectionState().ServerName; name != "" {
+			info.serverName = name
+		}
 	}
 
-	if d, ok := ctx.Value(WriteTimeoutKey{}).(time.Duration); ok && d != 0 {
-		conn.SetWriteDeadline(time.Now().Add(d))
+	if t.route.Mode == ModeHTTP {
+		conn.SetDeadline(time.Time{})
+		t.track(metered)
+		defer t.untrack(metered)
+		return t.serveHTTP(ctx, conn, info)
 	}
 
-	return t.forward(ctx, conn, t.forwardAddr)
+	upstream, conn, err := t.selectUpstream(conn, info)
+	if err != nil {
+		info.closing(closedByProxy, reasonServerName, err)
+		return err
+	}
+
+	conn.SetDeadline(time.Time{})
+	t.track(metered)
+	defer t.untrack(metered)
+	return t.forward(ctx, conn, upstream, info)
+}
+
+// selectUpstream returns upstream by server name of SNI route and connection replaying peeked ClientHello
+func (t *proxyServer) selectUpstream(conn net.Conn, info *connInfo) (*upstream, net.Conn, error) {
+
+	if len(t.sni) == 0 {
+		return t.upstream, conn, nil
+	}
+
+	serverName := info.serverName
+	if _, ok := conn.(*tls.Conn); !ok {
+		name, peeked, err := peekServerName(conn)
+		if err != nil {
+			t.log.Printf("ProxyServe '%s' rejected client '%s', %v\n", t.listenAddr, addrString(conn.RemoteAddr()), err)
+			return nil, nil, err
+		}
+		serverName, conn = name, peeked
+		info.serverName = name
+	}
+
+	if upstream := matchSNI(t.sni, serverName); upstream != nil {
+		return upstream, conn, nil
+	}
+
+	if len(t.upstream.backends) == 0 {
+		t.log.Printf("ProxyServe '%s' rejected client '%s', unknown server name '%s'\n", t.listenAddr, addrString(conn.RemoteAddr()), serverName)
+		return nil, nil, errors.Errorf("unknown server name '%s'", serverName)
+	}
+
+	return t.upstream, conn, nil
+}
+
+// backends returns backends of all upstreams
+func (t *proxyServer) backends() []*backend {
+	list := t.upstream.backends
+	for _, s := range t.sni {
+		list = append(list[:len(list):len(list)], s.upstream.backends...)
+	}
+	for _, h := range t.httpRoutes {
+		list = append(list[:len(list):len(list)], h.upstream.backends...)
+	}
+	return list
+}
+
+// notifyChanged wakes up clients held by all upstreams
+func (t *proxyServer) notifyChanged() {
+	t.upstream.notifyChanged()
+	for _, s := range t.sni {
+		s.upstream.notifyChanged()
+	}
+	for _, h := range t.httpRoutes {
+		h.upstream.notifyChanged()
+	}
+}
+
+// Shutdown stops accepting connections and lets active ones finish within drain timeout
+func (t *proxyServer) Shutdown(drainTimeout time.Duration) error {
+	t.drainTimeout.Store(drainTimeout)
+	return t.Close()
 }
 
 func (t *proxyServer) Close() (err error) {
@@ -147,54 +594,190 @@ func (t *proxyServer) Close() (err error) {
 	return nil
 }
 
-func (t *proxyServer) forward(ctx context.Context, conn net.Conn, destAddr string) error {
+func (t *proxyServer) setHealthy(b *backend, healthy bool, err error) {
+	b.healthy.Store(healthy)
+	if healthy {
+		t.log.Printf("ProxyServe '%s' backend '%s' is up\n", t.listenAddr, b.addr)
+	} else {
+		t.log.Printf("ProxyServe '%s' backend '%s' is down, %v\n", t.listenAddr, b.addr, err)
+	}
+	t.notifyChanged()
+}
+
+// tryPick chooses available backend of upstream not in exclude set without waiting
+func (t *proxyServer) tryPick(upstream *upstream, client net.Addr, exclude map[*backend]bool) *backend {
 
-	target, err := net.Dial("tcp", destAddr)
+	busy := make(map[*backend]bool)
+
+	for {
+		b := upstream.pick(client, func(b *backend) bool {
+			return !exclude[b] && !busy[b] && b.available()
+		})
+
+		if b != nil && b.breaker != nil && !b.breaker.acquire() {
+			// other client took the trial connection
+			busy[b] = true
+			continue
+		}
+
+		return b
+	}
+}
+
+// pickBackend chooses available backend, when all are down it rejects or holds client depending on route
+func (t *proxyServer) pickBackend(ctx context.Context, upstream *upstream, client net.Addr) *backend {
+
+	hold := time.Duration(t.route.DownHold)
+	if hold == 0 {
+		hold = time.Duration(DefaultDownHold)
+	}
+
+	var timer *time.Timer
+
+	for {
+		changed := upstream.stateChanged()
+
+		if b := t.tryPick(upstream, client, nil); b != nil || t.route.DownAction != DownActionHold {
+			return b
+		}
+
+		if timer == nil {
+			timer = time.NewTimer(hold)
+			defer timer.Stop()
+		}
+
+		select {
+		case <- changed:
+		case <- time.After(downHoldPoll):
+			// ejection of backends expires without notification
+		case <- timer.C:
+			return nil
+		case <- ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (t *proxyServer) dialFailed(b *backend, err error) {
+	b.dialFailures.Inc()
+	t.log.Printf("ProxyServe '%s' dial backend '%s' error, %v\n", t.listenAddr, b.addr, err)
+	t.breakerFailure(b)
+}
+
+func (t *proxyServer) breakerFailure(b *backend) {
+	if b.breaker == nil {
+		return
+	}
+	if ejection := b.breaker.failure(); ejection > 0 {
+		t.log.Printf("ProxyServe '%s' backend '%s' ejected for %s\n", t.listenAddr, b.addr, ejection)
+		t.notifyChanged()
+	}
+}
+
+func (t *proxyServer) breakerSuccess(b *backend) {
+	if b.breaker != nil && b.breaker.success() {
+		t.log.Printf("ProxyServe '%s' backend '%s' restored after trial connection\n", t.listenAddr, b.addr)
+		t.notifyChanged()
+	}
+}
+
+func (t *proxyServer) forward(ctx context.Context, conn net.Conn, upstream *upstream, info *connInfo) error {
+
+	target, backend, err := t.dialUpstream(ctx, upstream, info)
 	if err != nil {
+		if backend == nil {
+			t.log.Printf("ProxyServe '%s' rejected client '%s', no available backends\n", t.listenAddr, conn.RemoteAddr())
+		}
+		info.closing(closedByProxy, reasonNoBackend, err)
 		return err
 	}
+
+	return t.relay(ctx, conn, target, backend, info)
+}
+
+// relay copies data between client and dialed backend connection until both sides finish,
+// the first finished direction tells the side closed first
+func (t *proxyServer) relay(ctx context.Context, conn, target net.Conn, backend *backend, info *connInfo) error {
 	defer target.Close()
 
+	backend.total.Inc()
+	backend.active.Inc()
+	defer backend.active.Dec()
+
+	// backend works once it answers, so long trial connection does not keep breaker half-open
+	var answered atomic.Bool
+	success := func() {
+		if answered.CAS(false, true) {
+			t.breakerSuccess(backend)
+		}
+	}
+
 	// Start proxying
-	s2cCh := proxy(target, conn)
-	c2sCh := proxy(conn, target)
+	s2cCh := proxy(target, conn, nil)
+	c2sCh := proxy(conn, target, success)
 	var total int64
+	var earlyReset, unanswered, clientDone bool
 
 	defer func() {
 
-		if t.verbose {
-			t.log.Printf("Traffic from '%s' to '%s' amount %d\n", conn.RemoteAddr().String(),  target.RemoteAddr().String(), total)
+		if earlyReset {
+			backend.earlyResets.Inc()
+		}
+		if earlyReset || unanswered {
+			t.breakerFailure(backend)
 		}
 
-		go func() {
-			// make sure that all goroutings already finished
-			time.Sleep(time.Millisecond * 100)
-			close(s2cCh)
-			close(c2sCh)
-		}()
+		if t.verbose.Load() {
+			t.log.Printf("Traffic from '%s' to '%s' backend '%s' amount %d\n", addrString(conn.RemoteAddr()), addrString(target.RemoteAddr()), backend.addr, total)
+		}
 	}()
 
 	// We don't know which side is going to stop sending first, so we need a select between the two.
 	for i := 0; i < 2; i++ {
 		select {
 		case <- ctx.Done():
+			info.closing(closedByProxy, reasonShutdown, nil)
 			target.Close()
 			conn.Close()
 			i++
 		case s2c := <-s2cCh:
+			clientDone = true
 			total += s2c.Cnt
+			backend.bytesIn.Add(s2c.Cnt)
+			if s2c.Err == nil || s2c.Err == io.EOF {
+				info.closing(closedByClient, reasonEOF, nil)
+			} else if s2c.ReadErr {
+				info.closing(closedByClient, reasonError, s2c.Err)
+			} else {
+				info.closing(closedByBackend, reasonError, s2c.Err)
+			}
 			if s2c.Err == io.EOF {
 				break // select, continue with client
 			}
 			if s2c.Err != nil {
+				// backend reset connection before the request was written
+				earlyReset = !s2c.ReadErr && !answered.Load() && !errors.Is(s2c.Err, net.ErrClosed)
 				return errors.Errorf("server closed connection with error: %v", s2c.Err)
 			}
 		case c2s := <-c2sCh:
 			total += c2s.Cnt
+			backend.bytesOut.Add(c2s.Cnt)
+			if c2s.Err == nil || c2s.Err == io.EOF {
+				info.closing(closedByBackend, reasonEOF, nil)
+				// backend closed first without any response
+				unanswered = !clientDone && !answered.Load()
+			} else if c2s.ReadErr {
+				info.closing(closedByBackend, reasonError, c2s.Err)
+			} else {
+				info.closing(closedByClient, reasonError, c2s.Err)
+			}
 			if c2s.Err == io.EOF {
 				break // select, continue with server
 			}
 			if c2s.Err != nil {
+				// backend reset connection without any response, not closed here by idle timeout or shutdown,
+				// failed write to the client is not the fault of backend
+				earlyReset = c2s.ReadErr && !answered.Load() && !errors.Is(c2s.Err, net.ErrClosed)
 				return errors.Errorf("client closed connection with error: %v", c2s.Err)
 			}
 		}
@@ -203,9 +786,38 @@ func (t *proxyServer) forward(ctx context.Context, conn net.Conn, destAddr strin
 
 }
 
+// addrString prints address of any connection, unix socket peers could have no address
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
 type proxyResult struct {
 	Cnt int64
 	Err error
+	// error is of reading the source, otherwise of writing the destination
+	ReadErr bool
+}
+
+// sourceReader keeps read error of the source apart and tells about its first data
+type sourceReader struct {
+	io.Reader
+	err    error
+	onData func()
+}
+
+func (t *sourceReader) Read(p []byte) (int, error) {
+	n, err := t.Reader.Read(p)
+	if n > 0 && t.onData != nil {
+		t.onData()
+		t.onData = nil
+	}
+	if err != nil && err != io.EOF {
+		t.err = err
+	}
+	return n, err
 }
 
 type closeWriter interface {
@@ -213,15 +825,16 @@ type closeWriter interface {
 }
 
 // proxy is used to suffle data from src to destination, and sends errors
-// down to dedicated channel
-func proxy(dst io.Writer, src io.Reader) chan proxyResult {
+// down to dedicated channel, onData is called on the first data of src if not nil
+func proxy(dst io.Writer, src io.Reader, onData func()) chan proxyResult {
 	ret := make(chan proxyResult, 1)
 	go func() {
-		cnt, err := io.Copy(dst, src)
+		reader := &sourceReader{Reader: src, onData: onData}
+		cnt, err := io.Copy(dst, reader)
 		//if tcpConn, ok := dst.(closeWriter); ok {
 		//	tcpConn.CloseWrite()
 		//}
-		ret <- proxyResult{cnt, err}
+		ret <- proxyResult{cnt, err, err != nil && err == reader.err}
 	}()
 	return ret
 }
@@ -9,7 +9,7 @@ import (
 	"bytes"
 	"context"
 	"errors"
-	proxy "github.com/antihosting/port-proxy"
+	proxy "github.com/antihosting/tcp-proxy"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
 	"io"
@@ -17,6 +17,8 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -33,17 +35,17 @@ func TestHTTPProxy(t *testing.T) {
 
 	go server.ListenAndServe()
 	
-	var ports []proxy.ForwardPort
+	var routes []proxy.Route
 
-	ports = append(ports, proxy.ForwardPort{
-		SrcPort: 50550,
-		DstPort: 50551,
+	routes = append(routes, proxy.Route{
+		ListenAddr:  "127.0.0.1:50550",
+		ForwardAddr: "127.0.0.1:50551",
 	})
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	go proxy.RunProxy(ctx, "127.0.0.1", ports, log.Default(), false)
+	go proxy.RunProxy(ctx, &proxy.Config{Routes: routes}, nil, log.Default())
 
 	payload := make([]byte, bs)
 
@@ -99,14 +101,14 @@ func TestSocketProxy(t *testing.T) {
 	defer echo.Close()
 	go echo.Serve()
 
-	var ports []proxy.ForwardPort
+	var routes []proxy.Route
 
-	ports = append(ports, proxy.ForwardPort{
-		SrcPort: 50450,
-		DstPort: 50451,
+	routes = append(routes, proxy.Route{
+		ListenAddr:  "127.0.0.1:50450",
+		ForwardAddr: "127.0.0.1:50451",
 	})
 
-	go proxy.RunProxy(ctx, "127.0.0.1", ports, log.Default(), false)
+	go proxy.RunProxy(ctx, &proxy.Config{Routes: routes}, nil, log.Default())
 
 	time.Sleep(time.Millisecond)
 
@@ -162,3 +164,149 @@ func TestSocketProxy(t *testing.T) {
 
 }
 
+
+func TestIPv6Proxy(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	echo := proxy.NewEchoServer(ctx, "[::1]:50651")
+	if err := echo.Bind(); err != nil {
+		t.Skipf("IPv6 is not available, %v", err)
+	}
+
+	defer echo.Close()
+	go echo.Serve()
+
+	route, err := proxy.ParseRoute("[::]:50650:[::1]:50651")
+	require.NoError(t, err)
+
+	go proxy.RunProxy(ctx, &proxy.Config{Routes: []proxy.Route{route}}, nil, log.Default())
+
+	time.Sleep(time.Millisecond * 10)
+
+	// dual-stack listener accepts both families
+	for _, addr := range []string{"[::1]:50650", "127.0.0.1:50650"} {
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte("ping"))
+		require.NoError(t, err)
+
+		answer := make([]byte, 4)
+		_, err = io.ReadFull(conn, answer)
+		require.NoError(t, err)
+		require.Equal(t, "ping", string(answer))
+
+		conn.Close()
+	}
+
+}
+
+func TestUnixSocketProxy(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+
+	echo := proxy.NewEchoServer(ctx, "127.0.0.1:50751")
+	require.NoError(t, echo.Bind())
+
+	defer echo.Close()
+	go echo.Serve()
+
+	// unix socket listener to tcp backend and tcp listener to unix socket backend
+	listenPath := filepath.Join(dir, "proxy.sock")
+	routes := []proxy.Route{
+		{ListenAddr: "unix:" + listenPath, ForwardAddr: "127.0.0.1:50751", UnixMode: "0600"},
+		{ListenAddr: "127.0.0.1:50750", ForwardAddr: "unix:" + listenPath},
+	}
+
+	go proxy.RunProxy(ctx, &proxy.Config{Routes: routes}, nil, log.Default())
+
+	time.Sleep(time.Millisecond * 10)
+
+	info, err := os.Stat(listenPath)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	conn, err := net.Dial("tcp", "127.0.0.1:50750")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	answer := make([]byte, 4)
+	_, err = io.ReadFull(conn, answer)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(answer))
+
+}
+
+func TestUDPProxy(t *testing.T) {
+
+	echo, err := net.ListenPacket("udp4", "127.0.0.1:50851")
+	require.NoError(t, err)
+	defer echo.Close()
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	route, err := proxy.ParseRoute("udp/127.0.0.1:50850:127.0.0.1:50851")
+	require.NoError(t, err)
+	route.SessionTimeout = proxy.Duration(time.Millisecond * 100)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go proxy.RunProxy(ctx, &proxy.Config{Routes: []proxy.Route{route}}, nil, log.Default())
+
+	time.Sleep(time.Millisecond * 10)
+
+	// the second client works after the first session is expired
+	for i := 0; i < 2; i++ {
+
+		conn, err := net.Dial("udp4", "127.0.0.1:50850")
+		require.NoError(t, err)
+
+		for j := 0; j < 3; j++ {
+
+			_, err = conn.Write([]byte("ping"))
+			require.NoError(t, err)
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			answer := make([]byte, 16)
+			n, err := conn.Read(answer)
+			require.NoError(t, err)
+			require.Equal(t, "ping", string(answer[:n]))
+		}
+
+		conn.Close()
+		time.Sleep(time.Millisecond * 200)
+	}
+
+}
+
+func TestUDPResolve(t *testing.T) {
+
+	route, err := proxy.ParseRoute("udp/127.0.0.1:50852:no-such-host.invalid:53")
+	require.NoError(t, err)
+
+	// backend is resolved when route starts, not on the first datagram of the client
+	server := proxy.NewUDPServer(context.Background(), route, log.New(ioutil.Discard, "", 0), false)
+	err = server.Bind()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no-such-host.invalid")
+
+}
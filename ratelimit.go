@@ -0,0 +1,250 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	RateActionReject = "reject"
+	RateActionTarpit = "tarpit"
+)
+
+var (
+	DefaultTarpit = Duration(10 * time.Second)
+
+	// tarpit holds connections, beyond this number limited clients are rejected
+	maxTarpitConns = 1024
+
+	// limited clients are logged once per interval with the number of skipped ones
+	rateLogInterval = 10 * time.Second
+)
+
+// RateLimit is token bucket of new connections per client address or its network prefix,
+// bucket of rate tokens per second holds up to burst tokens
+type RateLimit struct {
+	Rate  float64 `json:"rate" yaml:"rate"`
+	Burst int     `json:"burst,omitempty" yaml:"burst,omitempty"`
+
+	// clients of the same network share the bucket, every address has own bucket if empty
+	IPv4Prefix int `json:"ipv4_prefix,omitempty" yaml:"ipv4_prefix,omitempty"`
+	IPv6Prefix int `json:"ipv6_prefix,omitempty" yaml:"ipv6_prefix,omitempty"`
+
+	// limited client is rejected or held without answer for tarpit time
+	Action string   `json:"action,omitempty" yaml:"action,omitempty"`
+	Tarpit Duration `json:"tarpit,omitempty" yaml:"tarpit,omitempty"`
+}
+
+func (t *RateLimit) Validate() error {
+	if t.Rate <= 0 {
+		return errors.New("connection rate must be positive")
+	}
+	if t.Burst < 0 || t.Tarpit < 0 {
+		return errors.New("negative rate limit settings")
+	}
+	if t.IPv4Prefix < 0 || t.IPv4Prefix > 32 || t.IPv6Prefix < 0 || t.IPv6Prefix > 128 {
+		return errors.New("invalid rate limit prefix, expected 1-32 for ipv4 and 1-128 for ipv6")
+	}
+	switch t.Action {
+	case "", RateActionReject, RateActionTarpit:
+	default:
+		return errors.Errorf("unknown rate limit action '%s', expected %s or %s", t.Action, RateActionReject, RateActionTarpit)
+	}
+	return nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	mask4  net.IPMask
+	mask6  net.IPMask
+	tarpit time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+
+	limited   atomic.Int64
+	tarpitted atomic.Int64
+
+	sparse sparseLog
+}
+
+func newRateLimiter(conf RateLimit) *rateLimiter {
+	t := &rateLimiter{
+		rate:    conf.Rate,
+		burst:   float64(conf.Burst),
+		mask4:   net.CIDRMask(32, 32),
+		mask6:   net.CIDRMask(128, 128),
+		buckets: make(map[string]*tokenBucket),
+		swept:   time.Now(),
+		sparse:  sparseLog{interval: rateLogInterval},
+	}
+	if t.burst == 0 {
+		t.burst = math.Max(1, math.Ceil(conf.Rate))
+	}
+	if conf.IPv4Prefix > 0 {
+		t.mask4 = net.CIDRMask(conf.IPv4Prefix, 32)
+	}
+	if conf.IPv6Prefix > 0 {
+		t.mask6 = net.CIDRMask(conf.IPv6Prefix, 128)
+	}
+	if conf.Action == RateActionTarpit {
+		t.tarpit = time.Duration(conf.Tarpit)
+		if t.tarpit == 0 {
+			t.tarpit = time.Duration(DefaultTarpit)
+		}
+	}
+	return t
+}
+
+func (t *rateLimiter) String() string {
+	t.mu.Lock()
+	clients := len(t.buckets)
+	t.mu.Unlock()
+	return fmt.Sprintf("RateLimit {rate=%g burst=%g clients=%d limited=%d tarpitted=%d}",
+		t.rate, t.burst, clients, t.limited.Load(), t.tarpitted.Load())
+}
+
+// key returns client address masked by the prefix, empty for not ip addresses
+func (t *rateLimiter) key(addr net.Addr) string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(t.mask4).String()
+	}
+	return ip.Mask(t.mask6).String()
+}
+
+// allow takes token of the client bucket, false if the bucket is empty
+func (t *rateLimiter) allow(addr net.Addr) bool {
+
+	key := t.key(addr)
+	if key == "" {
+		return true
+	}
+
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sweep(now)
+
+	b, ok := t.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: t.burst, last: now}
+		t.buckets[key] = b
+	}
+
+	b.tokens = math.Min(t.burst, b.tokens+now.Sub(b.last).Seconds()*t.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		t.limited.Inc()
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep removes buckets that are full again, they are the same as new ones
+func (t *rateLimiter) sweep(now time.Time) {
+	refill := time.Duration(t.burst / t.rate * float64(time.Second))
+	if now.Sub(t.swept) < refill || now.Sub(t.swept) < time.Second {
+		return
+	}
+	t.swept = now
+	for key, b := range t.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(t.buckets, key)
+		}
+	}
+}
+
+// hold waits for tarpit time keeping limited client without answer, false if tarpit is full
+func (t *rateLimiter) hold(ctx context.Context) bool {
+
+	if t.tarpitted.Inc() > int64(maxTarpitConns) {
+		t.tarpitted.Dec()
+		return false
+	}
+	defer t.tarpitted.Dec()
+
+	timer := time.NewTimer(t.tarpit)
+	defer timer.Stop()
+
+	select {
+	case <- timer.C:
+	case <- ctx.Done():
+	}
+	return true
+}
+
+// sparseLog allows one message per interval and counts skipped ones
+type sparseLog struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	last    time.Time
+	skipped int
+}
+
+// allow returns true with the number of skipped messages if message could be logged now
+func (t *sparseLog) allow() (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.last) < t.interval {
+		t.skipped++
+		return 0, false
+	}
+
+	skipped := t.skipped
+	t.last, t.skipped = now, 0
+	return skipped, true
+}
+
+// rateLimited takes token of the client, limited client is counted and logged
+func (t *proxyServer) rateLimited(conn net.Conn) bool {
+
+	if t.rateLimiter.allow(conn.RemoteAddr()) {
+		return false
+	}
+
+	if skipped, ok := t.rateLimiter.sparse.allow(); ok {
+		t.log.Printf("ProxyServe '%s' rate limited client '%s', skipped %d messages %v\n", t.listenAddr, addrString(conn.RemoteAddr()), skipped, t.rateLimiter)
+	}
+	return true
+}
+
+// rejectLimited closes connection of rate limited client, in tarpit mode after the tarpit time
+func (t *proxyServer) rejectLimited(ctx context.Context, conn net.Conn) {
+	if t.rateLimiter.tarpit > 0 {
+		t.rateLimiter.hold(ctx)
+	}
+	conn.Close()
+}
@@ -0,0 +1,120 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+
+	limiter := newRateLimiter(RateLimit{Rate: 0.001, Burst: 2, IPv4Prefix: 24, IPv6Prefix: 64})
+
+	addr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 50000}
+	}
+
+	// the same /24 shares the bucket
+	require.True(t, limiter.allow(addr("192.0.2.10")))
+	require.True(t, limiter.allow(addr("192.0.2.11")))
+	require.False(t, limiter.allow(addr("192.0.2.12")))
+	require.True(t, limiter.allow(addr("198.51.100.1")))
+
+	// the same /64 shares the bucket
+	require.True(t, limiter.allow(addr("2001:db8::1")))
+	require.True(t, limiter.allow(addr("2001:db8::2")))
+	require.False(t, limiter.allow(addr("2001:db8::3")))
+	require.True(t, limiter.allow(addr("2001:db8:1::1")))
+
+	// unix clients are not limited
+	for i := 0; i < 5; i++ {
+		require.True(t, limiter.allow(&net.UnixAddr{Name: "@", Net: "unix"}))
+	}
+
+	require.Equal(t, int64(2), limiter.limited.Load())
+
+	sparse := sparseLog{interval: time.Hour}
+	_, ok := sparse.allow()
+	require.True(t, ok)
+	_, ok = sparse.allow()
+	require.False(t, ok)
+	sparse.last = time.Time{}
+	skipped, ok := sparse.allow()
+	require.True(t, ok)
+	require.Equal(t, 1, skipped)
+}
+
+func TestRateLimit(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// backend answers once and closes
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.CopyN(conn, conn, 4)
+			}()
+		}
+	}()
+
+	routes := []Route{
+		{ListenAddr: "127.0.0.1:51750", ForwardAddr: listener.Addr().String(), RateLimit: &RateLimit{Rate: 0.001, Burst: 2}},
+		{ListenAddr: "127.0.0.1:51751", ForwardAddr: listener.Addr().String(), RateLimit: &RateLimit{Rate: 0.001, Action: RateActionTarpit, Tarpit: Duration(300 * time.Millisecond)}},
+	}
+
+	for _, route := range routes {
+		require.NoError(t, route.Validate())
+		server := NewProxyServer(ctx, route, log.Default(), false)
+		require.NoError(t, server.Bind())
+		defer server.Close()
+		go server.Serve()
+	}
+
+	echo := func(addr string) (time.Duration, error) {
+		start := time.Now()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return 0, err
+		}
+		_, err = io.ReadFull(conn, make([]byte, 4))
+		return time.Since(start), err
+	}
+
+	// burst of two connections passes, the third one is rejected
+	for i := 0; i < 2; i++ {
+		_, err := echo("127.0.0.1:51750")
+		require.NoError(t, err)
+	}
+	_, err = echo("127.0.0.1:51750")
+	require.Error(t, err)
+
+	// limited client is held in tarpit before close
+	_, err = echo("127.0.0.1:51751")
+	require.NoError(t, err)
+	elapsed, err := echo("127.0.0.1:51751")
+	require.Error(t, err)
+	require.GreaterOrEqual(t, int64(elapsed), int64(250*time.Millisecond))
+}
@@ -0,0 +1,243 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startDaemon binds and serves routes like RunProxy without signal handling
+func startDaemon(t *testing.T, ctx context.Context, routes []Route) *proxyDaemon {
+
+	ctx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+
+	g, _ := errgroup.WithContext(ctx)
+	daemon := &proxyDaemon{ctx: ctx, log: log.Default(), g: g, cancel: cancel, servers: make(map[string]server)}
+
+	var serverList []server
+	for _, route := range routes {
+		serverList = append(serverList, daemon.newServer(route, false))
+	}
+	require.NoError(t, bindAll(serverList, daemon.log))
+	daemon.serveAll(serverList)
+
+	t.Cleanup(func() {
+		closeAll(daemon.serverList(), daemon.log)
+	})
+	return daemon
+}
+
+// echoBackend echoes every connection until client closes
+func echoBackend(t *testing.T) net.Listener {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func ping(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(conn, make([]byte, 4))
+	return err
+}
+
+func dialPing(network, addr string) (net.Conn, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := ping(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func TestReload(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := echoBackend(t).Addr().String()
+
+	kept := Route{ListenAddr: "127.0.0.1:52350", ForwardAddr: backend}
+	removed := Route{ListenAddr: "127.0.0.1:52351", ForwardAddr: backend}
+	added := Route{ListenAddr: "127.0.0.1:52352", ForwardAddr: backend}
+
+	daemon := startDaemon(t, ctx, []Route{kept, removed})
+	keptServer := daemon.servers[routeKey(kept)]
+
+	live, err := dialPing("tcp", kept.ListenAddr)
+	require.NoError(t, err)
+	defer live.Close()
+
+	daemon.reload(func() (*Config, error) {
+		return &Config{Routes: []Route{kept, added}, DrainTimeout: Duration(time.Second)}, nil
+	})
+
+	require.Equal(t, 2, len(daemon.servers))
+	require.Same(t, keptServer, daemon.servers[routeKey(kept)])
+	require.NotNil(t, daemon.servers[routeKey(added)])
+
+	// unchanged route keeps its connections
+	require.NoError(t, ping(live))
+
+	conn, err := dialPing("tcp", added.ListenAddr)
+	require.NoError(t, err)
+	conn.Close()
+
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", removed.ListenAddr)
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReloadRejected(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := echoBackend(t).Addr().String()
+
+	route := Route{ListenAddr: "127.0.0.1:52360", ForwardAddr: backend}
+	daemon := startDaemon(t, ctx, []Route{route})
+	running := daemon.servers[routeKey(route)]
+
+	live, err := dialPing("tcp", route.ListenAddr)
+	require.NoError(t, err)
+	defer live.Close()
+
+	// config failing validation
+	daemon.reload(func() (*Config, error) {
+		conf := &Config{Routes: []Route{{ListenAddr: "127.0.0.1:52361", ForwardAddr: "nowhere"}}}
+		if err := conf.Normalize(); err != nil {
+			return nil, err
+		}
+		return conf, nil
+	})
+
+	// route with missing certificate replaces the running one
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	daemon.reload(func() (*Config, error) {
+		return &Config{Routes: []Route{{ListenAddr: "127.0.0.1:52361", ForwardAddr: backend, TLS: &TLS{Cert: missing, Key: missing}}}}, nil
+	})
+
+	// listen address of the new route is busy
+	busy, err := net.Listen("tcp", "127.0.0.1:52362")
+	require.NoError(t, err)
+	defer busy.Close()
+	daemon.reload(func() (*Config, error) {
+		return &Config{Routes: []Route{{ListenAddr: "127.0.0.1:52362", ForwardAddr: backend}}}, nil
+	})
+
+	daemon.reload(func() (*Config, error) {
+		return nil, errors.New("broken config")
+	})
+
+	require.Equal(t, 1, len(daemon.servers))
+	require.Same(t, running, daemon.servers[routeKey(route)])
+	require.NoError(t, ping(live))
+}
+
+func TestReloadRestore(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := echoBackend(t).Addr().String()
+
+	socket := filepath.Join(t.TempDir(), "proxy.sock")
+	route := Route{ListenAddr: "unix:" + socket, ForwardAddr: backend}
+	daemon := startDaemon(t, ctx, []Route{route})
+
+	// changed route takes the socket of the removed one and fails to bind after it is closed
+	changed := route
+	changed.UnixOwner = "no-such-user-52370"
+	added := Route{ListenAddr: "127.0.0.1:52370", ForwardAddr: backend}
+
+	daemon.reload(func() (*Config, error) {
+		return &Config{Routes: []Route{changed, added}, DrainTimeout: Duration(time.Second)}, nil
+	})
+
+	require.Equal(t, 1, len(daemon.servers))
+	require.NotNil(t, daemon.servers[routeKey(route)])
+
+	conn, err := dialPing("unix", socket)
+	require.NoError(t, err)
+	conn.Close()
+
+	// bound listener of the other new route is closed
+	_, err = net.Dial("tcp", added.ListenAddr)
+	require.Error(t, err)
+}
+
+// failingListener breaks accept loop with an error that is not a close
+type failingListener struct {
+	net.Listener
+}
+
+func (t failingListener) Accept() (net.Conn, error) {
+	return nil, errors.New("accept failed")
+}
+
+func TestServeFailureStopsDaemon(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _ := errgroup.WithContext(ctx)
+	daemon := &proxyDaemon{ctx: ctx, log: log.Default(), g: g, cancel: cancel, servers: make(map[string]server)}
+
+	failing := daemon.newServer(Route{ListenAddr: "127.0.0.1:52390", ForwardAddr: "127.0.0.1:52391"}, false)
+	require.NoError(t, bindAll([]server{failing}, daemon.log))
+	defer failing.Close()
+
+	proxyServer := failing.(*proxyServer)
+	proxyServer.listener = failingListener{proxyServer.listener}
+
+	// the same keep-alive as RunProxy must not hold the daemon with nothing serving
+	g.Go(func() error {
+		<-ctx.Done()
+		return nil
+	})
+	daemon.serveAll([]server{failing})
+
+	select {
+	case <- ctx.Done():
+	case <- time.After(5 * time.Second):
+		t.Fatal("daemon keeps running after server failed")
+	}
+	require.EqualError(t, g.Wait(), "accept failed")
+}
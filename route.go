@@ -0,0 +1,907 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Route struct {
+	// tcp by default or udp
+	Protocol string `json:"protocol,omitempty" yaml:"protocol,omitempty"`
+
+	ListenAddr  string `json:"listen" yaml:"listen"`
+	ForwardAddr string `json:"forward,omitempty" yaml:"forward,omitempty"`
+
+	// pool of backends used instead of forward address
+	Backends []Backend `json:"backends,omitempty" yaml:"backends,omitempty"`
+	Balance  string    `json:"balance,omitempty" yaml:"balance,omitempty"`
+
+	// tls connections are routed by server name, forward address or backends are default for unknown names
+	SNI []SNIRoute `json:"sni,omitempty" yaml:"sni,omitempty"`
+
+	// tcp forwards bytes, http parses requests and routes them by host and path prefix
+	Mode       string      `json:"mode,omitempty" yaml:"mode,omitempty"`
+	HTTPRoutes []HTTPRoute `json:"http_routes,omitempty" yaml:"http_routes,omitempty"`
+
+	// active health check of all backends
+	HealthCheck *HealthCheck `json:"health_check,omitempty" yaml:"health_check,omitempty"`
+
+	// passive ejection of failing backends
+	CircuitBreaker *CircuitBreaker `json:"circuit_breaker,omitempty" yaml:"circuit_breaker,omitempty"`
+
+	// when all backends are down client is rejected or held for the hold time until some backend is up
+	DownAction string   `json:"down_action,omitempty" yaml:"down_action,omitempty"`
+	DownHold   Duration `json:"down_hold,omitempty" yaml:"down_hold,omitempty"`
+
+	// clients allowed and denied by CIDRs or IPs of lists and access file, deny wins,
+	// all clients not denied are allowed if allow lists are empty
+	Allow      []string `json:"allow,omitempty" yaml:"allow,omitempty"`
+	Deny       []string `json:"deny,omitempty" yaml:"deny,omitempty"`
+	AccessFile string   `json:"access_file,omitempty" yaml:"access_file,omitempty"`
+
+	// max concurrent client connections, unlimited if empty
+	ConnLimit *ConnLimit `json:"conn_limit,omitempty" yaml:"conn_limit,omitempty"`
+
+	// max rate of new connections by client address, unlimited if empty
+	RateLimit *RateLimit `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`
+
+	// upload and download limits of connections, clients and the route, unlimited if empty
+	Bandwidth *Bandwidth `json:"bandwidth,omitempty" yaml:"bandwidth,omitempty"`
+
+	// listen on IPv6 only, by default [::] and empty host accept IPv4 connections as well
+	IPv6Only bool `json:"ipv6_only,omitempty" yaml:"ipv6_only,omitempty"`
+
+	// terminate tls on the listener
+	TLS *TLS `json:"tls,omitempty" yaml:"tls,omitempty"`
+
+	// originate tls to backends
+	UpstreamTLS *UpstreamTLS `json:"upstream_tls,omitempty" yaml:"upstream_tls,omitempty"`
+
+	// send PROXY protocol header v1 or v2 with client address to backends
+	SendProxy string `json:"send_proxy,omitempty" yaml:"send_proxy,omitempty"`
+
+	// receive PROXY protocol header with the real client address from load balancer
+	AcceptProxy *AcceptProxy `json:"accept_proxy,omitempty" yaml:"accept_proxy,omitempty"`
+
+	// unix socket listener permissions like "0660", owner and group are names or ids
+	UnixMode  string `json:"unix_mode,omitempty" yaml:"unix_mode,omitempty"`
+	UnixOwner string `json:"unix_owner,omitempty" yaml:"unix_owner,omitempty"`
+	UnixGroup string `json:"unix_group,omitempty" yaml:"unix_group,omitempty"`
+
+	// connections without reads and writes in both directions are closed after idle timeouts
+	ClientIdleTimeout   Duration `json:"client_idle_timeout,omitempty" yaml:"client_idle_timeout,omitempty"`
+	UpstreamIdleTimeout Duration `json:"upstream_idle_timeout,omitempty" yaml:"upstream_idle_timeout,omitempty"`
+
+	// time for client to finish TLS handshake or send ClientHello of SNI route, and for backend TLS handshake
+	HandshakeTimeout Duration `json:"handshake_timeout,omitempty" yaml:"handshake_timeout,omitempty"`
+	DialTimeout      Duration `json:"dial_timeout,omitempty" yaml:"dial_timeout,omitempty"`
+
+	// dial retries, no retries if empty
+	Retry *Retry `json:"retry,omitempty" yaml:"retry,omitempty"`
+
+	// udp session without datagrams in both directions expires after this timeout
+	SessionTimeout Duration `json:"session_timeout,omitempty" yaml:"session_timeout,omitempty"`
+}
+
+// route without custom unmarshalers
+type routeFields Route
+
+type Backend struct {
+	Addr   string `json:"addr" yaml:"addr"`
+	Weight int    `json:"weight,omitempty" yaml:"weight,omitempty"`
+
+	// overrides health check of the route
+	HealthCheck *HealthCheck `json:"health_check,omitempty" yaml:"health_check,omitempty"`
+}
+
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+const (
+	ModeTCP  = "tcp"
+	ModeHTTP = "http"
+)
+
+const (
+	DownActionReject = "reject"
+	DownActionHold   = "hold"
+)
+
+var DefaultDownHold = Duration(10 * time.Second)
+
+// backend without custom unmarshalers
+type backendFields Backend
+
+func (t Route) String() string {
+	if len(t.SNI) > 0 {
+		list := make([]string, 0, len(t.SNI)+1)
+		for _, s := range t.SNI {
+			list = append(list, s.String())
+		}
+		if t.ForwardAddr != "" || len(t.Backends) > 0 {
+			list = append(list, "*="+targetsString(t.ForwardAddr, t.Backends))
+		}
+		return fmt.Sprintf("%s%s:sni(%s)", t.protocolPrefix(), t.ListenAddr, strings.Join(list, " "))
+	}
+	if len(t.HTTPRoutes) > 0 {
+		list := make([]string, 0, len(t.HTTPRoutes)+1)
+		for _, h := range t.HTTPRoutes {
+			list = append(list, h.String())
+		}
+		if t.ForwardAddr != "" || len(t.Backends) > 0 {
+			list = append(list, "*="+targetsString(t.ForwardAddr, t.Backends))
+		}
+		return fmt.Sprintf("%s%s:http(%s)", t.protocolPrefix(), t.ListenAddr, strings.Join(list, " "))
+	}
+	return fmt.Sprintf("%s%s:%s", t.protocolPrefix(), t.ListenAddr, targetsString(t.ForwardAddr, t.Backends))
+}
+
+func targetsString(forwardAddr string, backends []Backend) string {
+	if len(backends) > 0 {
+		addrs := make([]string, len(backends))
+		for i, b := range backends {
+			addrs[i] = b.Addr
+		}
+		return strings.Join(addrs, ",")
+	}
+	return forwardAddr
+}
+
+// protocolPrefix is empty for tcp routes and "udp/" for udp routes
+func (t Route) protocolPrefix() string {
+	if t.Protocol == "" || t.Protocol == ProtocolTCP {
+		return ""
+	}
+	return t.Protocol + "/"
+}
+
+// Targets returns backends of the route, forward address is the single backend,
+// SNI route could have no default backends
+func (t Route) Targets() []Backend {
+	return targets(t.ForwardAddr, t.Backends)
+}
+
+func targets(forwardAddr string, backends []Backend) []Backend {
+	if len(backends) > 0 {
+		return backends
+	}
+	if forwardAddr == "" {
+		return nil
+	}
+	return []Backend{{Addr: forwardAddr, Weight: 1}}
+}
+
+// ParseRoute parses route in format [proto/][listenip:]src:[host:]dst, where proto is tcp or udp, src and dst
+// could be port ranges of equal length like 30000-30099:40000-40099,
+// unix socket like unix:/run/app.sock and IPv6 hosts are in brackets like [::]:80:[2001:db8::5]:8080,
+// omitted hosts are left empty and could be filled by WithDefaultHost
+func ParseRoute(value string) (Route, error) {
+
+	var protocol string
+	if i := strings.IndexByte(value, '/'); i != -1 {
+		switch value[:i] {
+		case ProtocolTCP:
+			value = value[i+1:]
+		case ProtocolUDP:
+			protocol, value = ProtocolUDP, value[i+1:]
+		}
+	}
+
+	route, err := parseRoute(value)
+	route.Protocol = protocol
+	return route, err
+}
+
+func parseRoute(value string) (Route, error) {
+
+	var listenHost, src, forwardHost, dst string
+
+	parts, err := splitRoute(value)
+	if err != nil {
+		return Route{}, errors.Errorf("invalid route '%s', %v", value, err)
+	}
+
+	// unix socket endpoints are "unix:/path" with no port
+	var listenUnix, forwardUnix string
+	if len(parts) >= 3 && parts[0] == UnixPrefix {
+		listenUnix = UnixPrefix + ":" + parts[1]
+		parts = append([]string{"0"}, parts[2:]...)
+	}
+	if len(parts) >= 3 && parts[len(parts)-2] == UnixPrefix {
+		forwardUnix = UnixPrefix + ":" + parts[len(parts)-1]
+		parts = append(parts[:len(parts)-2], "0")
+	}
+
+	if listenUnix != "" || forwardUnix != "" {
+		return parseUnixRoute(value, parts, listenUnix, forwardUnix)
+	}
+
+	switch len(parts) {
+	case 2:
+		src, dst = parts[0], parts[1]
+	case 3:
+		if isPortRange(parts[0]) {
+			src, forwardHost, dst = parts[0], parts[1], parts[2]
+		} else {
+			listenHost, src, dst = parts[0], parts[1], parts[2]
+		}
+	case 4:
+		listenHost, src, forwardHost, dst = parts[0], parts[1], parts[2], parts[3]
+	default:
+		return Route{}, errors.Errorf("invalid route '%s', expected format [listenip:]src:[host:]dst", value)
+	}
+
+	listenHost, forwardHost = unbracket(listenHost), unbracket(forwardHost)
+
+	srcFrom, srcTo, err := parsePortRange(src)
+	if err != nil {
+		return Route{}, errors.Errorf("invalid source port in route '%s', %v", value, err)
+	}
+
+	dstFrom, dstTo, err := parsePortRange(dst)
+	if err != nil {
+		return Route{}, errors.Errorf("invalid destination port in route '%s', %v", value, err)
+	}
+
+	if dstFrom != dstTo && srcTo-srcFrom != dstTo-dstFrom {
+		return Route{}, errors.Errorf("source and destination port ranges in route '%s' have different length", value)
+	}
+
+	return Route{
+		ListenAddr:  net.JoinHostPort(listenHost, src),
+		ForwardAddr: net.JoinHostPort(forwardHost, dst),
+	}, nil
+}
+
+// parseUnixRoute parses route with unix socket endpoints replaced by port 0
+func parseUnixRoute(value string, parts []string, listenUnix, forwardUnix string) (Route, error) {
+
+	var listenHost, src, forwardHost, dst string
+
+	switch {
+	case len(parts) == 2:
+		src, dst = parts[0], parts[1]
+	case len(parts) == 3 && listenUnix != "":
+		src, forwardHost, dst = parts[0], parts[1], parts[2]
+	case len(parts) == 3 && forwardUnix != "":
+		listenHost, src, dst = parts[0], parts[1], parts[2]
+	default:
+		return Route{}, errors.Errorf("invalid route '%s', expected format [listenip:]src:[host:]dst where src and dst could be unix:/path", value)
+	}
+
+	route := Route{ListenAddr: listenUnix, ForwardAddr: forwardUnix}
+
+	if listenUnix == "" {
+		if _, _, err := parsePortRange(src); err != nil {
+			return Route{}, errors.Errorf("invalid source port in route '%s', %v", value, err)
+		}
+		route.ListenAddr = net.JoinHostPort(unbracket(listenHost), src)
+	}
+
+	if forwardUnix == "" {
+		if _, _, err := parsePortRange(dst); err != nil {
+			return Route{}, errors.Errorf("invalid destination port in route '%s', %v", value, err)
+		}
+		route.ForwardAddr = net.JoinHostPort(unbracket(forwardHost), dst)
+	}
+
+	if _, err := route.Expand(); err != nil {
+		return Route{}, errors.Errorf("invalid route '%s', %v", value, err)
+	}
+
+	return route, nil
+}
+
+// Expand returns one route per port for the route with port ranges,
+// backend ports could be single port shared by all routes or range of the same length
+func (t Route) Expand() ([]Route, error) {
+
+	listen, err := parseAddrRange(t.ListenAddr)
+	if err != nil {
+		return nil, errors.Errorf("invalid listen address, %v", err)
+	}
+
+	var forward addrRange
+
+	if len(t.Backends) == 0 && (t.ForwardAddr != "" || !t.routed()) {
+
+		forward, err = parseAddrRange(t.ForwardAddr)
+		if err != nil {
+			return nil, errors.Errorf("invalid forward address, %v", err)
+		}
+
+		if forward.size() != 0 && listen.size() != forward.size() {
+			return nil, errors.Errorf("listen range %s and forward range %s have different length", listen, forward)
+		}
+	}
+
+	backends := make([]addrRange, len(t.Backends))
+	for i, b := range t.Backends {
+
+		backends[i], err = parseAddrRange(b.Addr)
+		if err != nil {
+			return nil, errors.Errorf("invalid backend address '%s', %v", b.Addr, err)
+		}
+
+		if backends[i].size() != 0 && listen.size() != backends[i].size() {
+			return nil, errors.Errorf("listen range %s and backend range %s have different length", listen, backends[i])
+		}
+	}
+
+	routes := make([]Route, 0, listen.size()+1)
+	for i := 0; i <= listen.size(); i++ {
+		route := t
+		route.ListenAddr = listen.at(i)
+		if len(t.Backends) == 0 && t.ForwardAddr != "" {
+			route.ForwardAddr = forward.at(i)
+		} else {
+			route.Backends = make([]Backend, len(t.Backends))
+			for j, b := range t.Backends {
+				b.Addr = backends[j].at(i)
+				route.Backends[j] = b
+			}
+		}
+		routes = append(routes, route)
+	}
+
+	return routes, nil
+}
+
+// FormatRoutes prints routes collapsing consecutive ports with the same hosts and options into ranges
+func FormatRoutes(routes []Route) string {
+
+	var list []string
+
+	for i := 0; i < len(routes); {
+
+		j := i + 1
+		for j < len(routes) && isNextRoute(routes[j-1], routes[j]) {
+			j++
+		}
+
+		if j-i == 1 {
+			list = append(list, routes[i].String())
+		} else {
+			first, last := routes[i], routes[j-1]
+			listenHost, listenFrom, _ := splitAddr(first.ListenAddr)
+			forwardHost, forwardFrom, _ := splitAddr(first.ForwardAddr)
+			_, listenTo, _ := splitAddr(last.ListenAddr)
+			_, forwardTo, _ := splitAddr(last.ForwardAddr)
+			list = append(list, fmt.Sprintf("%s%s:%s", first.protocolPrefix(),
+				net.JoinHostPort(listenHost, fmt.Sprintf("%d-%d", listenFrom, listenTo)),
+				net.JoinHostPort(forwardHost, fmt.Sprintf("%d-%d", forwardFrom, forwardTo))))
+		}
+
+		i = j
+	}
+
+	return "[" + strings.Join(list, " ") + "]"
+}
+
+func isNextRoute(prev, next Route) bool {
+
+	prevListenHost, prevListenPort, err := splitAddr(prev.ListenAddr)
+	if err != nil {
+		return false
+	}
+	prevForwardHost, prevForwardPort, err := splitAddr(prev.ForwardAddr)
+	if err != nil {
+		return false
+	}
+	nextListenHost, nextListenPort, err := splitAddr(next.ListenAddr)
+	if err != nil {
+		return false
+	}
+	nextForwardHost, nextForwardPort, err := splitAddr(next.ForwardAddr)
+	if err != nil {
+		return false
+	}
+
+	if prevListenHost != nextListenHost || prevForwardHost != nextForwardHost ||
+		prevListenPort+1 != nextListenPort || prevForwardPort+1 != nextForwardPort {
+		return false
+	}
+
+	// the rest of options must be the same
+	prev.ListenAddr, prev.ForwardAddr = "", ""
+	next.ListenAddr, next.ForwardAddr = "", ""
+	return routeKey(prev) == routeKey(next)
+}
+
+// WithDefaultHost returns route with empty listen and forward hosts replaced by host
+func (t Route) WithDefaultHost(host string) Route {
+	t.ListenAddr = withDefaultHost(t.ListenAddr, host)
+	if len(t.Backends) > 0 {
+		backends := make([]Backend, len(t.Backends))
+		for i, b := range t.Backends {
+			b.Addr = withDefaultHost(b.Addr, host)
+			backends[i] = b
+		}
+		t.Backends = backends
+	} else if t.ForwardAddr != "" {
+		t.ForwardAddr = withDefaultHost(t.ForwardAddr, host)
+	}
+	if len(t.SNI) > 0 {
+		list := make([]SNIRoute, len(t.SNI))
+		for i, s := range t.SNI {
+			r := Route{ForwardAddr: s.ForwardAddr, Backends: s.Backends}.WithDefaultHost(host)
+			s.ForwardAddr, s.Backends = r.ForwardAddr, r.Backends
+			list[i] = s
+		}
+		t.SNI = list
+	}
+	if len(t.HTTPRoutes) > 0 {
+		list := make([]HTTPRoute, len(t.HTTPRoutes))
+		for i, h := range t.HTTPRoutes {
+			r := Route{ForwardAddr: h.ForwardAddr, Backends: h.Backends}.WithDefaultHost(host)
+			h.ForwardAddr, h.Backends = r.ForwardAddr, r.Backends
+			list[i] = h
+		}
+		t.HTTPRoutes = list
+	}
+	return t
+}
+
+// routed is true for routes choosing backends by server name or http request, their default backends are optional
+func (t Route) routed() bool {
+	return len(t.SNI) > 0 || len(t.HTTPRoutes) > 0
+}
+
+// restricted is true when route has own access lists
+func (t Route) restricted() bool {
+	return len(t.Allow) > 0 || len(t.Deny) > 0 || t.AccessFile != ""
+}
+
+func (t Route) Validate() error {
+
+	switch t.Protocol {
+	case "", ProtocolTCP:
+	case ProtocolUDP:
+		for _, b := range t.Targets() {
+			if isUnixAddr(b.Addr) {
+				return errors.Errorf("unix socket backend '%s' in udp route", b.Addr)
+			}
+			if b.HealthCheck != nil {
+				return errors.Errorf("health check of backend '%s' in udp route", b.Addr)
+			}
+		}
+		if isUnixAddr(t.ListenAddr) {
+			return errors.New("unix socket listener in udp route")
+		}
+		if t.HealthCheck != nil || t.CircuitBreaker != nil || t.TLS != nil || t.UpstreamTLS != nil || len(t.SNI) > 0 || t.Mode == ModeHTTP || t.SendProxy != "" || t.AcceptProxy != nil || t.RateLimit != nil || t.Bandwidth != nil || t.restricted() {
+			return errors.New("tls, sni, http mode, proxy protocol, health check, circuit breaker, access lists, rate and bandwidth limits are supported only in tcp routes")
+		}
+		if t.ConnLimit != nil && t.ConnLimit.Action == LimitActionQueue {
+			return errors.New("connection queue is supported only in tcp routes")
+		}
+	default:
+		return errors.Errorf("unknown protocol '%s', expected %s or %s", t.Protocol, ProtocolTCP, ProtocolUDP)
+	}
+
+	if err := checkAddr(t.ListenAddr); err != nil {
+		return errors.Errorf("invalid listen address, %v", err)
+	}
+
+	if t.TLS != nil {
+		if err := t.TLS.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if t.UpstreamTLS != nil {
+		if err := t.UpstreamTLS.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := checkProxyProtocol(t.SendProxy); err != nil {
+		return err
+	}
+
+	if t.AcceptProxy != nil {
+		if err := t.AcceptProxy.Validate(); err != nil {
+			return err
+		}
+		// header of any source could spoof the client address, unix socket is protected by its mode
+		if len(t.AcceptProxy.Trusted) == 0 && !isUnixAddr(t.ListenAddr) {
+			return errors.New("empty trusted proxies of accept_proxy")
+		}
+	}
+
+	if t.UnixMode != "" {
+		if _, err := strconv.ParseUint(t.UnixMode, 8, 32); err != nil {
+			return errors.Errorf("invalid unix socket mode '%s'", t.UnixMode)
+		}
+	}
+
+	switch t.Mode {
+	case "", ModeTCP:
+		if len(t.HTTPRoutes) > 0 {
+			return errors.New("http routes require http mode")
+		}
+	case ModeHTTP:
+		if len(t.SNI) > 0 {
+			return errors.New("sni routing and http mode are mutually exclusive")
+		}
+	default:
+		return errors.Errorf("unknown mode '%s', expected %s or %s", t.Mode, ModeTCP, ModeHTTP)
+	}
+
+	if !t.routed() || t.ForwardAddr != "" || len(t.Backends) > 0 {
+		if err := validateTargets(t.ForwardAddr, t.Backends); err != nil {
+			return err
+		}
+	}
+
+	hosts := make(map[string]bool)
+	for _, s := range t.SNI {
+		host := strings.ToLower(s.Host)
+		if err := checkHostPattern(host); err != nil {
+			return errors.Errorf("invalid sni host, %v", err)
+		}
+		if hosts[host] {
+			return errors.Errorf("duplicate sni host '%s'", s.Host)
+		}
+		hosts[host] = true
+		if err := validateTargets(s.ForwardAddr, s.Backends); err != nil {
+			return errors.Errorf("sni host '%s', %v", s.Host, err)
+		}
+	}
+
+	paths := make(map[string]bool)
+	for _, h := range t.HTTPRoutes {
+		if err := h.Validate(); err != nil {
+			return err
+		}
+		key := strings.ToLower(h.Host) + h.Path
+		if paths[key] {
+			return errors.Errorf("duplicate http route '%s'", h)
+		}
+		paths[key] = true
+	}
+
+	if err := checkBalance(t.Balance); err != nil {
+		return err
+	}
+
+	if t.HealthCheck != nil {
+		if err := t.HealthCheck.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if t.CircuitBreaker != nil {
+		if err := t.CircuitBreaker.Validate(); err != nil {
+			return err
+		}
+	}
+
+	switch t.DownAction {
+	case "", DownActionReject, DownActionHold:
+	default:
+		return errors.Errorf("unknown down action '%s', expected %s or %s", t.DownAction, DownActionReject, DownActionHold)
+	}
+
+	if t.DownHold < 0 {
+		return errors.New("negative down hold time")
+	}
+
+	if _, err := parseCIDRs(t.Allow); err != nil {
+		return errors.Errorf("invalid allow list, %v", err)
+	}
+	if _, err := parseCIDRs(t.Deny); err != nil {
+		return errors.Errorf("invalid deny list, %v", err)
+	}
+
+	if t.ConnLimit != nil {
+		if err := t.ConnLimit.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if t.RateLimit != nil {
+		if err := t.RateLimit.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if t.Bandwidth != nil {
+		if err := t.Bandwidth.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if t.ClientIdleTimeout < 0 || t.UpstreamIdleTimeout < 0 || t.HandshakeTimeout < 0 || t.DialTimeout < 0 || t.SessionTimeout < 0 {
+		return errors.New("negative socket timeout")
+	}
+
+	if t.Retry != nil {
+		if err := t.Retry.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateTargets(forwardAddr string, backends []Backend) error {
+
+	if len(backends) == 0 {
+		if err := checkAddr(forwardAddr); err != nil {
+			return errors.Errorf("invalid forward address, %v", err)
+		}
+		return nil
+	}
+
+	if forwardAddr != "" {
+		return errors.New("forward address and backends are mutually exclusive")
+	}
+
+	// metrics of backends are labeled by address
+	seen := make(map[string]bool, len(backends))
+	for _, b := range backends {
+		if err := checkAddr(b.Addr); err != nil {
+			return errors.Errorf("invalid backend address '%s', %v", b.Addr, err)
+		}
+		if seen[b.Addr] {
+			return errors.Errorf("duplicate backend address '%s'", b.Addr)
+		}
+		seen[b.Addr] = true
+		if b.Weight < 0 {
+			return errors.Errorf("negative weight of backend '%s'", b.Addr)
+		}
+		if b.HealthCheck != nil {
+			if err := b.HealthCheck.Validate(); err != nil {
+				return errors.Errorf("backend '%s', %v", b.Addr, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// UnmarshalJSON accepts short route string "[proto/][listenip:]src:[host:]dst" or full object
+func (t *Route) UnmarshalJSON(data []byte) error {
+	var value string
+	if json.Unmarshal(data, &value) == nil {
+		route, err := ParseRoute(value)
+		*t = route
+		return err
+	}
+	return json.Unmarshal(data, (*routeFields)(t))
+}
+
+// UnmarshalYAML accepts short route string "[proto/][listenip:]src:[host:]dst" or full object
+func (t *Route) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		route, err := ParseRoute(node.Value)
+		*t = route
+		return err
+	}
+	return node.Decode((*routeFields)(t))
+}
+
+// UnmarshalJSON accepts backend address string or full object
+func (t *Backend) UnmarshalJSON(data []byte) error {
+	var value string
+	if json.Unmarshal(data, &value) == nil {
+		*t = Backend{Addr: value}
+		return nil
+	}
+	return json.Unmarshal(data, (*backendFields)(t))
+}
+
+// UnmarshalYAML accepts backend address string or full object
+func (t *Backend) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*t = Backend{Addr: node.Value}
+		return nil
+	}
+	return node.Decode((*backendFields)(t))
+}
+
+// splitRoute splits route by colons outside of IPv6 brackets
+func splitRoute(value string) ([]string, error) {
+
+	var parts []string
+	start, inBrackets := 0, false
+
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '[':
+			if inBrackets || i != start {
+				return nil, errors.New("unexpected '['")
+			}
+			inBrackets = true
+		case ']':
+			if !inBrackets || (i+1 < len(value) && value[i+1] != ':') {
+				return nil, errors.New("unexpected ']'")
+			}
+			inBrackets = false
+		case ':':
+			if !inBrackets {
+				parts = append(parts, value[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	if inBrackets {
+		return nil, errors.New("missing ']'")
+	}
+
+	return append(parts, value[start:]), nil
+}
+
+func unbracket(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+func withDefaultHost(addr, host string) string {
+	if isUnixAddr(addr) {
+		return addr
+	}
+	h, port, err := net.SplitHostPort(addr)
+	if err != nil || h != "" {
+		return addr
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// listenNetwork returns network and address to listen: IPv4 literal is listened only by IPv4,
+// IPv6 wildcard, empty host and host names are dual-stack unless IPv6 only
+func listenNetwork(addr string, ipv6Only bool) (string, string) {
+	if isUnixAddr(addr) {
+		return "unix", unixPath(addr)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "tcp", addr
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil && ip.To4() != nil:
+		return "tcp4", addr
+	case ipv6Only:
+		return "tcp6", addr
+	default:
+		return "tcp", addr
+	}
+}
+
+// udpNetwork returns udp network of the same address family as tcp network
+func udpNetwork(network string) string {
+	return ProtocolUDP + strings.TrimPrefix(network, ProtocolTCP)
+}
+
+// dialNetwork returns network and address to dial
+func dialNetwork(addr string) (string, string) {
+	if isUnixAddr(addr) {
+		return "unix", unixPath(addr)
+	}
+	return "tcp", addr
+}
+
+func checkAddr(addr string) error {
+	if isUnixAddr(addr) {
+		if unixPath(addr) == "" {
+			return errors.New("empty unix socket path")
+		}
+		return nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	return checkPort(port)
+}
+
+func splitAddr(addr string) (string, int, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	p, err := strconv.Atoi(port)
+	return host, p, err
+}
+
+// addrRange is address with port range, unix socket address has no ports
+type addrRange struct {
+	unix     string
+	host     string
+	from, to int
+}
+
+func parseAddrRange(addr string) (addrRange, error) {
+	if isUnixAddr(addr) {
+		return addrRange{unix: addr}, checkAddr(addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addrRange{}, err
+	}
+	from, to, err := parsePortRange(port)
+	return addrRange{host: host, from: from, to: to}, err
+}
+
+func (t addrRange) String() string {
+	if t.unix != "" {
+		return t.unix
+	}
+	return fmt.Sprintf("%d-%d", t.from, t.to)
+}
+
+func (t addrRange) size() int {
+	return t.to - t.from
+}
+
+// at returns address of i-th port in range, the same address for single port
+func (t addrRange) at(i int) string {
+	if t.unix != "" {
+		return t.unix
+	}
+	port := t.from
+	if t.from != t.to {
+		port += i
+	}
+	return net.JoinHostPort(t.host, strconv.Itoa(port))
+}
+
+func isPortRange(s string) bool {
+	_, _, err := parsePortRange(s)
+	return err == nil
+}
+
+// parsePortRange parses single port or range in format from-to
+func parsePortRange(s string) (int, int, error) {
+
+	i := strings.IndexByte(s, '-')
+	if i == -1 {
+		if err := checkPort(s); err != nil {
+			return 0, 0, err
+		}
+		port, _ := strconv.Atoi(s)
+		return port, port, nil
+	}
+
+	if err := checkPort(s[:i]); err != nil {
+		return 0, 0, err
+	}
+	if err := checkPort(s[i+1:]); err != nil {
+		return 0, 0, err
+	}
+
+	from, _ := strconv.Atoi(s[:i])
+	to, _ := strconv.Atoi(s[i+1:])
+	if from > to {
+		return 0, 0, errors.Errorf("port range '%s' is reversed", s)
+	}
+
+	return from, to, nil
+}
+
+func checkPort(s string) error {
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return errors.Errorf("port '%s' is not a number", s)
+	}
+	if port <= 0 || port > 65535 {
+		return errors.Errorf("port '%d' is out of range", port)
+	}
+	return nil
+}
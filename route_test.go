@@ -0,0 +1,85 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy_test
+
+import (
+	proxy "github.com/antihosting/tcp-proxy"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseRoute(t *testing.T) {
+
+	cases := map[string]proxy.Route{
+		"80:8080":                  {ListenAddr: ":80", ForwardAddr: ":8080"},
+		"0.0.0.0:80:8080":          {ListenAddr: "0.0.0.0:80", ForwardAddr: ":8080"},
+		"80:10.0.0.5:8080":         {ListenAddr: ":80", ForwardAddr: "10.0.0.5:8080"},
+		"80:backend.local:8080":    {ListenAddr: ":80", ForwardAddr: "backend.local:8080"},
+		"0.0.0.0:80:10.0.0.5:8080": {ListenAddr: "0.0.0.0:80", ForwardAddr: "10.0.0.5:8080"},
+		"tcp/80:8080":              {ListenAddr: ":80", ForwardAddr: ":8080"},
+		"udp/53:10.0.0.5:5353":     {Protocol: proxy.ProtocolUDP, ListenAddr: ":53", ForwardAddr: "10.0.0.5:5353"},
+	}
+
+	for value, expected := range cases {
+		route, err := proxy.ParseRoute(value)
+		require.NoError(t, err, value)
+		require.Equal(t, expected, route, value)
+	}
+
+	for _, value := range []string{"80", "80:", "x:8080", "80:70000", "a:b:c:d:e", "100-199:200-298", "200-100:300-200", "[::1:80:8080", "::1:80:8080", "[::1]x:80:8080", "sctp/80:8080"} {
+		_, err := proxy.ParseRoute(value)
+		require.Error(t, err, value)
+	}
+
+	route, _ := proxy.ParseRoute("80:10.0.0.5:8080")
+	require.Equal(t, proxy.Route{ListenAddr: "127.0.0.1:80", ForwardAddr: "10.0.0.5:8080"}, route.WithDefaultHost("127.0.0.1"))
+
+	route, _ = proxy.ParseRoute("80:8080")
+	require.Equal(t, proxy.Route{ListenAddr: "[::1]:80", ForwardAddr: "[::1]:8080"}, route.WithDefaultHost("::1"))
+
+}
+
+func TestPortRange(t *testing.T) {
+
+	route, err := proxy.ParseRoute("0.0.0.0:30000-30099:10.0.0.5:40000-40099")
+	require.NoError(t, err)
+
+	routes, err := route.Expand()
+	require.NoError(t, err)
+	require.Equal(t, 100, len(routes))
+	require.Equal(t, proxy.Route{ListenAddr: "0.0.0.0:30000", ForwardAddr: "10.0.0.5:40000"}, routes[0])
+	require.Equal(t, proxy.Route{ListenAddr: "0.0.0.0:30099", ForwardAddr: "10.0.0.5:40099"}, routes[99])
+
+	single, err := proxy.ParseRoute("80:8080")
+	require.NoError(t, err)
+	routes = append(routes, single.WithDefaultHost("127.0.0.1"))
+
+	require.Equal(t, "[0.0.0.0:30000-30099:10.0.0.5:40000-40099 127.0.0.1:80:127.0.0.1:8080]", proxy.FormatRoutes(routes))
+
+	shared, err := proxy.ParseRoute("30000-30099:10.0.0.5:40000")
+	require.NoError(t, err)
+
+	routes, err = shared.Expand()
+	require.NoError(t, err)
+	require.Equal(t, 100, len(routes))
+	require.Equal(t, proxy.Route{ListenAddr: ":30000", ForwardAddr: "10.0.0.5:40000"}, routes[0])
+	require.Equal(t, proxy.Route{ListenAddr: ":30099", ForwardAddr: "10.0.0.5:40000"}, routes[99])
+
+}
+
+func TestHTTPRouteString(t *testing.T) {
+
+	route := proxy.Route{
+		Protocol:    proxy.ProtocolTCP,
+		ListenAddr:  "0.0.0.0:80",
+		ForwardAddr: "10.0.0.5:8080",
+		HTTPRoutes:  []proxy.HTTPRoute{{Host: "example.com", ForwardAddr: "10.0.0.6:8080"}},
+	}
+	require.Equal(t, "0.0.0.0:80:http(example.com=10.0.0.6:8080 *=10.0.0.5:8080)", route.String())
+
+	route.Protocol = proxy.ProtocolUDP
+	require.Equal(t, "udp/0.0.0.0:80:http(example.com=10.0.0.6:8080 *=10.0.0.5:8080)", route.String())
+
+}
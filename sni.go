@@ -0,0 +1,138 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// SNIRoute forwards TLS connections with the server name to own backends without terminating TLS
+type SNIRoute struct {
+
+	// exact name like app.example.com or wildcard of one label like *.example.com
+	Host string `json:"host" yaml:"host"`
+
+	ForwardAddr string    `json:"forward,omitempty" yaml:"forward,omitempty"`
+	Backends    []Backend `json:"backends,omitempty" yaml:"backends,omitempty"`
+}
+
+func (t SNIRoute) String() string {
+	return t.Host + "=" + targetsString(t.ForwardAddr, t.Backends)
+}
+
+// checkHostPattern checks name or wildcard of one label
+func checkHostPattern(host string) error {
+	if host == "" || strings.Contains(host[1:], "*") || (host[0] == '*' && !strings.HasPrefix(host, "*.")) {
+		return errors.Errorf("invalid host '%s', expected name or wildcard like *.example.com", host)
+	}
+	return nil
+}
+
+type sniUpstream struct {
+	host     string
+	upstream *upstream
+}
+
+// matchSNI returns upstream of exact name first, then of wildcard, nil if none matches
+func matchSNI(list []sniUpstream, serverName string) *upstream {
+
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if serverName == "" {
+		return nil
+	}
+
+	for _, s := range list {
+		if s.host == serverName {
+			return s.upstream
+		}
+	}
+
+	if i := strings.IndexByte(serverName, '.'); i > 0 {
+		wildcard := "*" + serverName[i:]
+		for _, s := range list {
+			if s.host == wildcard {
+				return s.upstream
+			}
+		}
+	}
+
+	return nil
+}
+
+// errHelloRead stops the handshake right after ClientHello is parsed
+var errHelloRead = errors.New("client hello read")
+
+// peekServerName reads ClientHello of the client and returns server name with connection replaying the read bytes
+func peekServerName(conn net.Conn) (string, net.Conn, error) {
+
+	var peeked bytes.Buffer
+	var serverName string
+
+	err := tls.Server(helloConn{reader: io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+
+	if err != errHelloRead {
+		return "", nil, errors.Errorf("invalid tls client hello, %v", err)
+	}
+
+	return serverName, &peekedConn{Conn: conn, reader: io.MultiReader(&peeked, conn)}, nil
+}
+
+// helloConn is read only connection for parsing ClientHello, nothing is sent to the client
+type helloConn struct {
+	reader io.Reader
+}
+
+func (t helloConn) Read(p []byte) (int, error) {
+	return t.reader.Read(p)
+}
+
+func (t helloConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func (t helloConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (t helloConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (t helloConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (t helloConn) LocalAddr() net.Addr {
+	return nil
+}
+
+func (t helloConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+func (t helloConn) Close() error {
+	return nil
+}
+
+// peekedConn reads peeked bytes before the rest of connection
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (t *peekedConn) Read(p []byte) (int, error) {
+	return t.reader.Read(p)
+}
@@ -0,0 +1,110 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/stretchr/testify/require"
+	"log"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchSNI(t *testing.T) {
+
+	exact, wildcard := &upstream{}, &upstream{}
+	list := []sniUpstream{
+		{host: "*.example.com", upstream: wildcard},
+		{host: "app.example.com", upstream: exact},
+	}
+
+	require.Same(t, exact, matchSNI(list, "app.example.com"))
+	require.Same(t, exact, matchSNI(list, "APP.example.com."))
+	require.Same(t, wildcard, matchSNI(list, "db.example.com"))
+	require.Nil(t, matchSNI(list, "a.db.example.com"))
+	require.Nil(t, matchSNI(list, "example.com"))
+	require.Nil(t, matchSNI(list, ""))
+}
+
+func TestSNIRouting(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+
+	// TLS backends answer with own certificates
+	backend := func(name string) string {
+		certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key")
+		writeTestCert(t, certFile, keyFile, name)
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		require.NoError(t, err)
+
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+		require.NoError(t, err)
+		go func() {
+			<-ctx.Done()
+			listener.Close()
+		}()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					conn.(*tls.Conn).Handshake()
+				}()
+			}
+		}()
+		return listener.Addr().String()
+	}
+
+	route := Route{
+		ListenAddr: "127.0.0.1:51150",
+		SNI: []SNIRoute{
+			{Host: "app.example.com", ForwardAddr: backend("app")},
+			{Host: "*.example.org", Backends: []Backend{{Addr: backend("org")}}},
+		},
+	}
+	require.NoError(t, route.Validate())
+
+	server := NewProxyServer(ctx, route, log.Default(), false)
+	require.NoError(t, server.Bind())
+	defer server.Close()
+	go server.Serve()
+
+	dial := func(serverName string) (string, error) {
+		conn, err := tls.Dial("tcp", "127.0.0.1:51150", &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+	}
+
+	name, err := dial("app.example.com")
+	require.NoError(t, err)
+	require.Equal(t, "app", name)
+
+	name, err = dial("www.example.org")
+	require.NoError(t, err)
+	require.Equal(t, "org", name)
+
+	// no default backend
+	_, err = dial("unknown.net")
+	require.Error(t, err)
+
+	// not TLS client
+	conn, err := net.Dial("tcp", "127.0.0.1:51150")
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+}
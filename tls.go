@@ -0,0 +1,258 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var DefaultTLSMinVersion = "1.2"
+
+// how often certificate files are checked for changes
+var certCheckInterval = 10 * time.Second
+
+// TLS terminates client connections on the listener, certificate is reloaded when files change
+type TLS struct {
+	Cert string `json:"cert" yaml:"cert"`
+	Key  string `json:"key" yaml:"key"`
+
+	// 1.0, 1.1, 1.2 or 1.3
+	MinVersion string `json:"min_version,omitempty" yaml:"min_version,omitempty"`
+
+	// cipher suite names like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, Go defaults if empty
+	Ciphers []string `json:"ciphers,omitempty" yaml:"ciphers,omitempty"`
+
+	// application protocols offered in ALPN, like h2 and http/1.1
+	ALPN []string `json:"alpn,omitempty" yaml:"alpn,omitempty"`
+}
+
+func (t *TLS) Validate() error {
+	if t.Cert == "" || t.Key == "" {
+		return errors.New("tls certificate and key files are required")
+	}
+	if _, err := parseTLSVersion(t.MinVersion); err != nil {
+		return err
+	}
+	if _, err := parseCipherSuites(t.Ciphers); err != nil {
+		return err
+	}
+	return nil
+}
+
+// config returns server config with certificate loaded from files
+func (t *TLS) config(log *log.Logger, name string) (*tls.Config, error) {
+
+	minVersion, err := parseTLSVersion(t.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphers, err := parseCipherSuites(t.Ciphers)
+	if err != nil {
+		return nil, err
+	}
+
+	reloader := &certReloader{certFile: t.Cert, keyFile: t.Key, log: log, name: name}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		GetCertificate: reloader.getCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   ciphers,
+		NextProtos:     t.ALPN,
+	}, nil
+}
+
+// UpstreamTLS originates tls to backends, client certificate is sent when backend requires mutual tls
+type UpstreamTLS struct {
+
+	// PEM bundle of trusted CAs, system roots if empty
+	CA string `json:"ca,omitempty" yaml:"ca,omitempty"`
+
+	// verified name of backends, host of the backend address if empty
+	ServerName string `json:"server_name,omitempty" yaml:"server_name,omitempty"`
+
+	Cert string `json:"cert,omitempty" yaml:"cert,omitempty"`
+	Key  string `json:"key,omitempty" yaml:"key,omitempty"`
+
+	MinVersion string `json:"min_version,omitempty" yaml:"min_version,omitempty"`
+
+	// do not verify backend certificates, only for labs
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty" yaml:"insecure_skip_verify,omitempty"`
+}
+
+func (t *UpstreamTLS) Validate() error {
+	if (t.Cert == "") != (t.Key == "") {
+		return errors.New("upstream tls client certificate and key must be set together")
+	}
+	if _, err := parseTLSVersion(t.MinVersion); err != nil {
+		return err
+	}
+	return nil
+}
+
+// config returns client config with CA bundle and client certificate loaded from files
+func (t *UpstreamTLS) config() (*tls.Config, error) {
+
+	minVersion, err := parseTLSVersion(t.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		ServerName:         t.ServerName,
+		MinVersion:         minVersion,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+
+	if t.CA != "" {
+		pem, err := ioutil.ReadFile(t.CA)
+		if err != nil {
+			return nil, errors.Errorf("fail to read upstream tls CA bundle, %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates in upstream tls CA bundle '%s'", t.CA)
+		}
+	}
+
+	if t.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, errors.Errorf("fail to load upstream tls client certificate '%s', %v", t.Cert, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		version = DefaultTLSMinVersion
+	}
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, errors.Errorf("unknown tls version '%s', expected 1.0, 1.1, 1.2 or 1.3", version)
+	}
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, len(names))
+	for i, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, errors.Errorf("unknown tls cipher suite '%s'", name)
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+// certReloader serves certificate and reloads it when modification time of files changes,
+// failed reload keeps the previous certificate
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	log  *log.Logger
+	name string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	lastCheck time.Time
+}
+
+func (t *certReloader) load() error {
+
+	certMod, keyMod, err := t.modTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return errors.Errorf("fail to load tls certificate '%s', %v", t.certFile, err)
+	}
+
+	t.cert, t.certMod, t.keyMod, t.lastCheck = &cert, certMod, keyMod, time.Now()
+	return nil
+}
+
+func (t *certReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(t.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.Errorf("fail to read tls certificate, %v", err)
+	}
+	keyInfo, err := os.Stat(t.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.Errorf("fail to read tls key, %v", err)
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+func (t *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if time.Since(t.lastCheck) < certCheckInterval {
+		return t.cert, nil
+	}
+	t.lastCheck = time.Now()
+
+	certMod, keyMod, err := t.modTimes()
+	if err != nil {
+		t.log.Printf("ProxyServe '%s' %v\n", t.name, err)
+		return t.cert, nil
+	}
+
+	if certMod.Equal(t.certMod) && keyMod.Equal(t.keyMod) {
+		return t.cert, nil
+	}
+	// files of failed reload are not loaded again until they change
+	t.certMod, t.keyMod = certMod, keyMod
+
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		t.log.Printf("ProxyServe '%s' reload tls certificate '%s' error, keep previous one, %v\n", t.name, t.certFile, err)
+		return t.cert, nil
+	}
+
+	t.cert = &cert
+	t.log.Printf("ProxyServe '%s' reloaded tls certificate '%s'\n", t.name, t.certFile)
+	return t.cert, nil
+}
@@ -0,0 +1,199 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes self-signed certificate for 127.0.0.1 with the common name
+func writeTestCert(t *testing.T, certFile, keyFile, name string) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{name},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+}
+
+func TestTLSTermination(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "first")
+
+	echo := NewEchoServer(ctx, "127.0.0.1:50951")
+	require.NoError(t, echo.Bind())
+	defer echo.Close()
+	go echo.Serve()
+
+	route := Route{
+		ListenAddr:  "127.0.0.1:50950",
+		ForwardAddr: "127.0.0.1:50951",
+		TLS:         &TLS{Cert: certFile, Key: keyFile, ALPN: []string{"echo"}},
+	}
+	require.NoError(t, route.Validate())
+
+	server := NewProxyServer(ctx, route, log.Default(), false)
+	require.NoError(t, server.Bind())
+	defer server.Close()
+	go server.Serve()
+
+	ping := func() string {
+		conn, err := tls.Dial("tcp", "127.0.0.1:50950", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"echo"}})
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.Equal(t, "echo", conn.ConnectionState().NegotiatedProtocol)
+
+		_, err = conn.Write([]byte("ping"))
+		require.NoError(t, err)
+
+		answer := make([]byte, 4)
+		_, err = io.ReadFull(conn, answer)
+		require.NoError(t, err)
+		require.Equal(t, "ping", string(answer))
+
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	require.Equal(t, "first", ping())
+
+	// renewed certificate is served without restart
+	certCheckInterval = 0
+	defer func() { certCheckInterval = 10 * time.Second }()
+
+	time.Sleep(time.Millisecond * 10)
+	writeTestCert(t, certFile, keyFile, "second")
+
+	require.Equal(t, "second", ping())
+
+	// broken files keep the previous certificate
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("broken"), 0600))
+	require.Equal(t, "second", ping())
+
+	_, err := tls.Dial("tcp", "127.0.0.1:50950", &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS11})
+	require.Error(t, err)
+}
+
+func TestUpstreamTLS(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "backend")
+
+	// backend with mutual tls trusts the same self-signed certificate
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pem, err := ioutil.ReadFile(certFile)
+	require.NoError(t, err)
+	pool.AppendCertsFromPEM(pem)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	require.NoError(t, err)
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	routes := []Route{
+		{
+			ListenAddr:  "127.0.0.1:51050",
+			ForwardAddr: listener.Addr().String(),
+			UpstreamTLS: &UpstreamTLS{CA: certFile, Cert: certFile, Key: keyFile},
+		},
+		{
+			// no client certificate
+			ListenAddr:  "127.0.0.1:51051",
+			ForwardAddr: listener.Addr().String(),
+			UpstreamTLS: &UpstreamTLS{CA: certFile},
+		},
+	}
+
+	for _, route := range routes {
+		require.NoError(t, route.Validate())
+		server := NewProxyServer(ctx, route, log.Default(), false)
+		require.NoError(t, server.Bind())
+		defer server.Close()
+		go server.Serve()
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:51050")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	answer := make([]byte, 4)
+	_, err = io.ReadFull(conn, answer)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(answer))
+
+	conn, err = net.Dial("tcp", "127.0.0.1:51051")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	conn.Write([]byte("ping"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(conn, answer)
+	require.Error(t, err)
+}
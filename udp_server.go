@@ -0,0 +1,417 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var DefaultSessionTimeout = Duration(time.Minute)
+
+// max size of udp datagram
+const maxDatagramSize = 64 * 1024
+
+// udpSession is the upstream socket of one client address
+type udpSession struct {
+	id      string
+	start   time.Time
+	client  net.Addr
+	conn    net.Conn
+	backend *backend
+
+	// unix nanos of the last datagram in any direction
+	lastSeen atomic.Int64
+
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	closeOnce sync.Once
+}
+
+func (t *udpSession) touch() {
+	t.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (t *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, t.lastSeen.Load()))
+}
+
+type udpServer struct {
+
+	ctx context.Context
+
+	route Route
+
+	listenAddr string
+	lc         net.ListenConfig
+	conn       net.PacketConn
+
+	cancelFn context.CancelFunc
+
+	forwardAddr string
+	upstream    *upstream
+
+	log     *log.Logger
+	verbose atomic.Bool
+
+	sessionTimeout time.Duration
+
+	// backend addresses are resolved once, so lookup never stalls the read loop of all clients
+	resolved map[*backend]*net.UDPAddr
+
+	// nil if access log is disabled
+	accessLog *accessLog
+
+	// sessions created and clients dropped without backend
+	accepted    atomic.Int64
+	unavailable atomic.Int64
+
+	// caps concurrent sessions, nil if unlimited
+	limiter *connLimiter
+
+	// new sessions are not created while route is disabled by admin api
+	disabled atomic.Bool
+	refused  atomic.Int64
+
+	// sessions by client address
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+
+	running   atomic.Bool
+	closeOnce sync.Once
+}
+
+func NewUDPServer(ctx context.Context, route Route, log *log.Logger, verbose bool) *udpServer {
+	upstream := newUpstream(route)
+	t := &udpServer{
+		ctx: ctx,
+		route: route,
+		listenAddr: route.ListenAddr,
+		forwardAddr: upstream.String(),
+		upstream: upstream,
+		log: log,
+		sessionTimeout: time.Duration(route.SessionTimeout),
+		sessions: make(map[string]*udpSession),
+	}
+	if t.sessionTimeout == 0 {
+		t.sessionTimeout = time.Duration(DefaultSessionTimeout)
+	}
+	if route.ConnLimit != nil {
+		t.limiter = newConnLimiter(*route.ConnLimit)
+	}
+	t.verbose.Store(verbose)
+	return t
+}
+
+func (t *udpServer) Route() Route {
+	return t.route
+}
+
+func (t *udpServer) SetVerbose(verbose bool) {
+	t.verbose.Store(verbose)
+}
+
+func (t *udpServer) String() string {
+	return fmt.Sprintf("UDPServer {%s to %s}", t.listenAddr, t.forwardAddr)
+}
+
+func (t *udpServer) prepare() error {
+
+	if t.resolved != nil {
+		return nil
+	}
+
+	resolved := make(map[*backend]*net.UDPAddr)
+	for _, b := range t.upstream.backends {
+		addr, err := net.ResolveUDPAddr(ProtocolUDP, b.addr)
+		if err != nil {
+			return errors.Errorf("fail to resolve backend 'udp/%s', %v", b.addr, err)
+		}
+		resolved[b] = addr
+	}
+
+	t.resolved = resolved
+	return nil
+}
+
+func (t *udpServer) Bind() (err error) {
+
+	if err := t.prepare(); err != nil {
+		return err
+	}
+
+	network, addr := listenNetwork(t.listenAddr, t.route.IPv6Only)
+	t.conn, err = t.lc.ListenPacket(t.ctx, udpNetwork(network), addr)
+	if err != nil {
+		return errors.Errorf("Listen address is busy 'udp/%s', %v", t.listenAddr, err)
+	}
+
+	return nil
+}
+
+func (t *udpServer) Serve() (err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch v := r.(type) {
+			case error:
+				err = v
+			case string:
+				err = errors.New(v)
+			default:
+				err = errors.Errorf("%v", v)
+			}
+		}
+	}()
+
+	var serveCtx context.Context
+	serveCtx, t.cancelFn = context.WithCancel(t.ctx)
+
+	t.log.Printf("UDPServe Started '%s' -> '%s'\n", t.listenAddr, t.forwardAddr)
+
+	go t.expire(serveCtx)
+
+	t.running.Store(true)
+	err = t.doServe(serveCtx)
+	t.running.Store(false)
+
+	t.cancelFn()
+	t.closeSessions()
+
+	if err != nil && strings.Contains(err.Error(), "closed") {
+		err = nil
+	}
+
+	t.log.Printf("UDPServe Ended '%s' -> '%s' with error %v\n", t.listenAddr, t.forwardAddr, err)
+	if t.verbose.Load() {
+		if t.limiter != nil {
+			t.log.Printf("UDPServe '%s' %v\n", t.listenAddr, t.limiter)
+		}
+		for _, b := range t.upstream.backends {
+			t.log.Printf("UDPServe '%s' %v\n", t.listenAddr, b)
+		}
+	}
+	return err
+}
+
+func (t *udpServer) doServe(ctx context.Context) error {
+
+	buf := make([]byte, maxDatagramSize)
+
+	for t.running.Load() {
+
+		n, client, err := t.conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		session := t.session(client)
+		if session == nil {
+			// datagram is dropped
+			continue
+		}
+
+		if _, err := session.conn.Write(buf[:n]); err != nil {
+			t.log.Printf("UDPServe '%s' write to backend '%s' error, %v\n", t.listenAddr, session.backend.addr, err)
+			t.closeSession(session, closedByBackend, reasonError, err)
+			continue
+		}
+		session.bytesIn.Add(int64(n))
+		session.backend.bytesIn.Add(int64(n))
+	}
+
+	return nil
+}
+
+// session returns existing session of the client or dials the new one, nil if no backend is available
+// or sessions are over the limit
+func (t *udpServer) session(client net.Addr) *udpSession {
+
+	key := client.String()
+
+	// touched under lock, so expire does not close the session before the datagram is written
+	t.mu.Lock()
+	session, ok := t.sessions[key]
+	if ok {
+		session.touch()
+	}
+	t.mu.Unlock()
+
+	if ok {
+		return session
+	}
+
+	if t.disabled.Load() {
+		t.refused.Inc()
+		return nil
+	}
+
+	if t.limiter != nil && !t.limiter.tryAcquire() {
+		if t.limiter.full.CAS(false, true) {
+			t.log.Printf("UDPServe '%s' session limit %d reached\n", t.listenAddr, t.limiter.max)
+		}
+		t.limiter.rejected.Inc()
+		return nil
+	}
+
+	b := t.upstream.pick(client, (*backend).available)
+	if b == nil {
+		t.releaseSlot()
+		t.unavailable.Inc()
+		t.log.Printf("UDPServe '%s' rejected client '%s', no available backends\n", t.listenAddr, client)
+		return nil
+	}
+
+	start := time.Now()
+	conn, err := net.DialUDP(ProtocolUDP, nil, t.resolved[b])
+	if err != nil {
+		t.releaseSlot()
+		t.unavailable.Inc()
+		b.dialFailures.Inc()
+		t.log.Printf("UDPServe '%s' dial backend '%s' error, %v\n", t.listenAddr, b.addr, err)
+		return nil
+	}
+
+	b.dialLatency.observe(time.Since(start))
+	t.accepted.Inc()
+
+	session = &udpSession{id: nextConnID(), start: time.Now(), client: client, conn: conn, backend: b}
+	session.touch()
+
+	t.mu.Lock()
+	t.sessions[key] = session
+	t.mu.Unlock()
+
+	b.total.Inc()
+	b.active.Inc()
+
+	go t.reply(session)
+	return session
+}
+
+func (t *udpServer) releaseSlot() {
+	if t.limiter != nil {
+		t.limiter.release()
+	}
+}
+
+// reply relays datagrams of the backend to the client until session is closed
+func (t *udpServer) reply(session *udpSession) {
+
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		n, err := session.conn.Read(buf)
+		if err != nil {
+			t.closeSession(session, closedByBackend, reasonError, err)
+			return
+		}
+
+		session.touch()
+		if _, err := t.conn.WriteTo(buf[:n], session.client); err != nil {
+			t.closeSession(session, closedByProxy, reasonError, err)
+			return
+		}
+		session.bytesOut.Add(int64(n))
+		session.backend.bytesOut.Add(int64(n))
+	}
+}
+
+// closeSession closes session once, the first caller tells who closed it and why
+func (t *udpServer) closeSession(session *udpSession, closedBy, reason string, err error) {
+
+	session.closeOnce.Do(func() {
+
+		t.mu.Lock()
+		if t.sessions[session.client.String()] == session {
+			delete(t.sessions, session.client.String())
+		}
+		t.mu.Unlock()
+
+		session.conn.Close()
+		session.backend.active.Dec()
+		t.releaseSlot()
+
+		if t.verbose.Load() {
+			t.log.Printf("UDP session from '%s' to backend '%s' in %d out %d\n", session.client, session.backend.addr, session.bytesIn.Load(), session.bytesOut.Load())
+		}
+
+		t.logAccess(session, closedBy, reason, err)
+	})
+}
+
+// expire closes sessions without datagrams longer than session timeout
+func (t *udpServer) expire(ctx context.Context) {
+
+	ticker := time.NewTicker(t.sessionTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <- ctx.Done():
+			return
+		case <- ticker.C:
+		}
+
+		// removed under lock, so the read loop could not write to the session closed here
+		var expired []*udpSession
+		t.mu.Lock()
+		for key, session := range t.sessions {
+			if session.idle() >= t.sessionTimeout {
+				delete(t.sessions, key)
+				expired = append(expired, session)
+			}
+		}
+		t.mu.Unlock()
+
+		for _, session := range expired {
+			t.closeSession(session, closedByProxy, reasonSessionTimeout, nil)
+		}
+	}
+}
+
+func (t *udpServer) closeSessions() {
+
+	t.mu.Lock()
+	list := make([]*udpSession, 0, len(t.sessions))
+	for _, session := range t.sessions {
+		list = append(list, session)
+	}
+	t.mu.Unlock()
+
+	for _, session := range list {
+		t.closeSession(session, closedByProxy, reasonShutdown, nil)
+	}
+}
+
+// Shutdown closes the socket at once, udp sessions could not outlive it because replies are sent through it
+func (t *udpServer) Shutdown(drainTimeout time.Duration) error {
+	return t.Close()
+}
+
+func (t *udpServer) Close() (err error) {
+	t.running.Store(false)
+
+	t.closeOnce.Do(func() {
+
+		if t.conn != nil {
+			err = t.conn.Close()
+			if err != nil && strings.Contains(err.Error(), "closed") {
+				err = nil
+			}
+		}
+
+	})
+
+	return nil
+}
@@ -0,0 +1,132 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UnixPrefix starts unix socket address like unix:/run/app.sock
+const UnixPrefix = "unix"
+
+func isUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, UnixPrefix+":")
+}
+
+func unixPath(addr string) string {
+	return strings.TrimPrefix(addr, UnixPrefix+":")
+}
+
+// removeStaleSocket removes socket file left by the crashed process, the socket of running process is kept
+func removeStaleSocket(path string) error {
+
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return errors.Errorf("file '%s' exists and it is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return errors.Errorf("socket '%s' is in use", path)
+	}
+
+	return os.Remove(path)
+}
+
+// listenUnix listens unix socket and applies permissions and owner of the route
+func (t *proxyServer) listenUnix(ctx context.Context, path string) (net.Listener, error) {
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	listener, err := t.lc.Listen(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setSocketPermissions(path, t.route.UnixMode, t.route.UnixOwner, t.route.UnixGroup); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+func setSocketPermissions(path, mode, owner, group string) error {
+
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return errors.Errorf("invalid unix socket mode '%s', %v", mode, err)
+		}
+		if err := os.Chmod(path, os.FileMode(m)); err != nil {
+			return err
+		}
+	}
+
+	if owner == "" && group == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+
+	if owner != "" {
+		id, err := lookupID(owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return errors.Errorf("unknown unix socket owner '%s', %v", owner, err)
+		}
+		uid = id
+	}
+
+	if group != "" {
+		id, err := lookupID(group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return errors.Errorf("unknown unix socket group '%s', %v", group, err)
+		}
+		gid = id
+	}
+
+	return os.Chown(path, uid, gid)
+}
+
+// lookupID returns numeric id as is or looks up the name
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
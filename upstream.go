@@ -0,0 +1,217 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	BalanceRoundRobin       = "round-robin"
+	BalanceRandom           = "random"
+	BalanceLeastConnections = "least-connections"
+	BalanceWeighted         = "weighted"
+	BalanceIPHash           = "ip-hash"
+)
+
+type backend struct {
+	addr   string
+	weight int
+
+	// nil if backend is not checked
+	check   *HealthCheck
+	healthy atomic.Bool
+
+	// nil if circuit breaker is disabled
+	breaker *breaker
+
+	// connections served by backend
+	active atomic.Int64
+	total  atomic.Int64
+
+	dialFailures atomic.Int64
+	earlyResets  atomic.Int64
+	dialLatency  *histogram
+
+	// client to backend and backend to client bytes
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	// current weight of smooth weighted round-robin, guarded by upstream mutex
+	currentWeight int
+}
+
+func (t *backend) String() string {
+	breaker := "disabled"
+	if t.breaker != nil {
+		breaker = t.breaker.State().String()
+	}
+	return fmt.Sprintf("Backend {%s healthy=%v breaker=%s active=%d total=%d dial_failures=%d early_resets=%d in=%d out=%d}",
+		t.addr, t.healthy.Load(), breaker, t.active.Load(), t.total.Load(), t.dialFailures.Load(), t.earlyResets.Load(), t.bytesIn.Load(), t.bytesOut.Load())
+}
+
+// upstream is the pool of route backends with the balancing strategy
+type upstream struct {
+	strategy string
+	backends []*backend
+
+	next atomic.Uint64
+	mu   sync.Mutex
+
+	// closed and replaced on every backend state change
+	changed chan struct{}
+}
+
+func newUpstream(route Route) *upstream {
+	t := &upstream{
+		strategy: route.Balance,
+		changed:  make(chan struct{}),
+	}
+	if t.strategy == "" {
+		t.strategy = BalanceRoundRobin
+	}
+	for _, b := range route.Targets() {
+		weight := b.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		check := b.HealthCheck
+		if check == nil {
+			check = route.HealthCheck
+		}
+		if check != nil {
+			c := check.withDefaults()
+			check = &c
+		}
+		backend := &backend{addr: b.Addr, weight: weight, check: check, dialLatency: newHistogram(dialLatencyBuckets)}
+		backend.healthy.Store(true)
+		if route.CircuitBreaker != nil {
+			backend.breaker = newBreaker(*route.CircuitBreaker)
+		}
+		t.backends = append(t.backends, backend)
+	}
+	return t
+}
+
+func (t *backend) available() bool {
+	return t.healthy.Load() && (t.breaker == nil || t.breaker.ready())
+}
+
+// stateChanged returns channel closed on next backend state change
+func (t *upstream) stateChanged() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.changed
+}
+
+func (t *upstream) notifyChanged() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+func (t *upstream) String() string {
+	addrs := make([]string, len(t.backends))
+	for i, b := range t.backends {
+		addrs[i] = b.addr
+	}
+	return strings.Join(addrs, ",")
+}
+
+// pick chooses backend for the client among backends accepted by the filter, nil filter accepts all
+func (t *upstream) pick(client net.Addr, filter func(*backend) bool) *backend {
+
+	candidates := t.backends
+	if filter != nil {
+		candidates = make([]*backend, 0, len(t.backends))
+		for _, b := range t.backends {
+			if filter(b) {
+				candidates = append(candidates, b)
+			}
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+
+	switch t.strategy {
+	case BalanceRandom:
+		return candidates[rand.Intn(len(candidates))]
+
+	case BalanceLeastConnections:
+		// start from the rotating position, so equal backends share the load
+		offset := int(t.next.Inc() % uint64(len(candidates)))
+		best := candidates[offset]
+		for i := 1; i < len(candidates); i++ {
+			b := candidates[(offset+i)%len(candidates)]
+			if b.active.Load() < best.active.Load() {
+				best = b
+			}
+		}
+		return best
+
+	case BalanceWeighted:
+		return t.pickWeighted(candidates)
+
+	case BalanceIPHash:
+		h := fnv.New32a()
+		h.Write([]byte(clientIP(client)))
+		return candidates[h.Sum32()%uint32(len(candidates))]
+
+	default:
+		return candidates[(t.next.Inc()-1)%uint64(len(candidates))]
+	}
+}
+
+// pickWeighted is smooth weighted round-robin, the same as in nginx
+func (t *upstream) pickWeighted(candidates []*backend) *backend {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var best *backend
+	total := 0
+	for _, b := range candidates {
+		b.currentWeight += b.weight
+		total += b.weight
+		if best == nil || b.currentWeight > best.currentWeight {
+			best = b
+		}
+	}
+	best.currentWeight -= total
+	return best
+}
+
+func clientIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func checkBalance(strategy string) error {
+	switch strategy {
+	case "", BalanceRoundRobin, BalanceRandom, BalanceLeastConnections, BalanceWeighted, BalanceIPHash:
+		return nil
+	default:
+		return errors.Errorf("unknown balance strategy '%s', expected one of %s, %s, %s, %s, %s", strategy,
+			BalanceRoundRobin, BalanceRandom, BalanceLeastConnections, BalanceWeighted, BalanceIPHash)
+	}
+}
@@ -0,0 +1,252 @@
+/**
+  Copyright (c) 2022 Zander Schwid & Co. LLC. All rights reserved.
+*/
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBalanceStrategies(t *testing.T) {
+
+	route := Route{
+		ListenAddr: "127.0.0.1:80",
+		Backends: []Backend{
+			{Addr: "10.0.0.1:8080", Weight: 5},
+			{Addr: "10.0.0.2:8080", Weight: 1},
+			{Addr: "10.0.0.3:8080", Weight: 1},
+		},
+	}
+
+	client := &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 50000}
+
+	route.Balance = BalanceRoundRobin
+	u := newUpstream(route)
+	for i := 0; i < 6; i++ {
+		require.Equal(t, u.backends[i%3], u.pick(client, nil))
+	}
+
+	route.Balance = BalanceWeighted
+	u = newUpstream(route)
+	counts := make(map[string]int)
+	for i := 0; i < 7; i++ {
+		counts[u.pick(client, nil).addr]++
+	}
+	require.Equal(t, map[string]int{"10.0.0.1:8080": 5, "10.0.0.2:8080": 1, "10.0.0.3:8080": 1}, counts)
+
+	route.Balance = BalanceLeastConnections
+	u = newUpstream(route)
+	u.backends[0].active.Store(3)
+	u.backends[1].active.Store(1)
+	u.backends[2].active.Store(2)
+	for i := 0; i < 3; i++ {
+		require.Equal(t, u.backends[1], u.pick(client, nil))
+	}
+
+	route.Balance = BalanceIPHash
+	u = newUpstream(route)
+	first := u.pick(client, nil)
+	for i := 0; i < 5; i++ {
+		require.Equal(t, first, u.pick(&net.TCPAddr{IP: client.IP, Port: 50001 + i}, nil))
+	}
+
+	route.Balance = BalanceRandom
+	u = newUpstream(route)
+	only := u.backends[2]
+	require.Equal(t, only, u.pick(client, func(b *backend) bool { return b == only }))
+	require.Nil(t, u.pick(client, func(b *backend) bool { return false }))
+
+}
+
+func TestCircuitBreaker(t *testing.T) {
+
+	b := newBreaker(CircuitBreaker{Failures: 2, Ejection: Duration(20 * time.Millisecond), MaxEjection: Duration(30 * time.Millisecond)})
+
+	require.True(t, b.acquire())
+	require.Equal(t, time.Duration(0), b.failure())
+	require.Equal(t, 20*time.Millisecond, b.failure())
+	require.Equal(t, breakerOpen, b.State())
+	require.False(t, b.ready())
+	require.False(t, b.acquire())
+
+	// late answer of connection started before ejection keeps backend ejected
+	require.False(t, b.success())
+	require.Equal(t, breakerOpen, b.State())
+
+	time.Sleep(20 * time.Millisecond)
+	require.True(t, b.ready())
+	require.True(t, b.acquire())
+	require.Equal(t, breakerHalfOpen, b.State())
+	require.False(t, b.acquire())
+
+	// failed trial doubles ejection up to the max
+	require.Equal(t, 30*time.Millisecond, b.failure())
+
+	time.Sleep(30 * time.Millisecond)
+	require.True(t, b.acquire())
+	require.True(t, b.success())
+	require.Equal(t, breakerClosed, b.State())
+
+}
+
+func TestDialFailover(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed.Close()
+
+	route := Route{
+		ListenAddr: "127.0.0.1:0",
+		Backends:   []Backend{{Addr: closed.Addr().String()}, {Addr: listener.Addr().String()}},
+		Retry:      &Retry{Attempts: 2, Backoff: Duration(time.Millisecond)},
+	}
+
+	server := NewProxyServer(context.Background(), route, log.New(ioutil.Discard, "", 0), false)
+
+	for i := 0; i < 2; i++ {
+		conn, b, err := server.dialUpstream(context.Background(), server.upstream, &connInfo{})
+		require.NoError(t, err)
+		require.Equal(t, listener.Addr().String(), b.addr)
+		conn.Close()
+	}
+
+	require.Equal(t, int64(1), server.upstream.backends[0].dialFailures.Load())
+
+}
+
+func TestEarlyResets(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// backend reads request and resets connection without response
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			io.ReadFull(conn, make([]byte, 4))
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		}
+	}()
+
+	route := Route{
+		ListenAddr:     "127.0.0.1:52380",
+		ForwardAddr:    listener.Addr().String(),
+		CircuitBreaker: &CircuitBreaker{Failures: 2, Ejection: Duration(time.Minute)},
+	}
+	proxyServer := NewProxyServer(ctx, route, log.New(ioutil.Discard, "", 0), false)
+	require.NoError(t, proxyServer.Bind())
+	defer proxyServer.Close()
+	go proxyServer.Serve()
+
+	b := proxyServer.upstream.backends[0]
+	for i := 1; i <= 2; i++ {
+		conn, err := net.Dial("tcp", route.ListenAddr)
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("ping"))
+		_, err = conn.Read(make([]byte, 1))
+		require.Error(t, err)
+		conn.Close()
+		require.Eventually(t, func() bool { return b.earlyResets.Load() == int64(i) }, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// successful dials in between do not reset the count of failures
+	require.Equal(t, breakerOpen, b.breaker.State())
+	require.False(t, b.available())
+}
+
+func TestUnansweredClose(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// backend reads request and closes connection without response
+	silent := acceptLoop(t, func(conn net.Conn) {
+		io.ReadFull(conn, make([]byte, 4))
+		conn.Close()
+	})
+
+	// backend reads request and closes connection after client
+	release := make(chan struct{})
+	patient := acceptLoop(t, func(conn net.Conn) {
+		io.ReadFull(conn, make([]byte, 4))
+		<-release
+		conn.Close()
+	})
+
+	serve := func(port int, backendAddr string) *backend {
+		route := Route{
+			ListenAddr:     fmt.Sprintf("127.0.0.1:%d", port),
+			ForwardAddr:    backendAddr,
+			CircuitBreaker: &CircuitBreaker{Failures: 1, Ejection: Duration(time.Minute)},
+		}
+		proxyServer := NewProxyServer(ctx, route, log.New(ioutil.Discard, "", 0), false)
+		require.NoError(t, proxyServer.Bind())
+		t.Cleanup(func() { proxyServer.Close() })
+		go proxyServer.Serve()
+		return proxyServer.upstream.backends[0]
+	}
+
+	b := serve(52381, silent)
+	conn, err := net.Dial("tcp", "127.0.0.1:52381")
+	require.NoError(t, err)
+	conn.Write([]byte("ping"))
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+
+	// backend closed first without any response
+	require.Eventually(t, func() bool { return b.active.Load() == 0 && b.breaker.State() == breakerOpen }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, int64(0), b.earlyResets.Load())
+
+	b = serve(52382, patient)
+	conn, err = net.Dial("tcp", "127.0.0.1:52382")
+	require.NoError(t, err)
+	conn.Write([]byte("ping"))
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	// client finished first, nothing is known about backend
+	require.Eventually(t, func() bool { return b.total.Load() == 1 && b.active.Load() == 0 }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, breakerClosed, b.breaker.State())
+}
+
+// acceptLoop serves every connection of a local listener by the handler
+func acceptLoop(t *testing.T, handler func(conn net.Conn)) string {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handler(conn)
+		}
+	}()
+	return listener.Addr().String()
+}